@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	ChariotCLI "github.com/imwux/chariot/cli"
 	ChariotContainer "github.com/imwux/chariot/container"
@@ -16,31 +22,58 @@ import (
 
 const DEFAULT_FILE_PERM = 0755
 
+var PHASES = []string{"configure", "build", "install"}
+
+var COMMANDS = []string{"build", "report", "fetch", "vendor", "sbom", "validate"}
+
 type Options struct {
-	cache          string
-	resetContainer bool
-	verbose        bool
-	quiet          bool
-	threads        uint
+	cache             string
+	resetContainer    bool
+	verbose           bool
+	quiet             bool
+	threads           uint
+	jobs              uint
+	rebuildDependents bool
+	keepGoing         bool
+	dryRun            bool
+	incremental       bool
+	from              string
+	timeout           time.Duration
+	offline           bool
 }
 
 type Context struct {
-	options *Options
-	targets []*Target
-	cli     *ChariotCLI.CLI
-	cache   ChariotCache
+	options    *Options
+	targets    []*Target
+	cli        *ChariotCLI.CLI
+	cache      ChariotCache
+	downloader *Downloader
+	vendor     *VendorBundle
+	vars       map[string]string
 }
 
 type Target struct {
 	tag                 Tag
+	version             string
+	vars                map[string]string
+	env                 map[string]string
 	dependencies        []*Target
 	runtimeDependencies []*Target
+	dependents          []*Target
 
-	built   bool
-	touched bool
-	redo    bool
+	fingerprint string
+	redo        bool
+	timings     []Timing
+	revision    *Revision
 
-	do func() error
+	source *SourceTarget
+	// where the output of the commands of the target goes while it is built, nil while it is not or if
+	// the output is not shown
+	verboseWriter *ChariotCLI.CLIWriter
+	errWriter     *ChariotCLI.CLIWriter
+
+	do    func(runCtx context.Context) error
+	fetch func(runCtx context.Context) error
 }
 
 type SourceModifier struct {
@@ -48,6 +81,12 @@ type SourceModifier struct {
 	source       *Target
 	file         string
 	cmd          string
+	strip        int
+	allowFuzz    bool
+	// file resolved against the config that declares it and the hashes of the patches it applies, for
+	// patch modifiers that do not come from a source
+	path   string
+	hashes []string
 }
 
 type SourceTarget struct {
@@ -55,7 +94,25 @@ type SourceTarget struct {
 
 	sourceType string
 	url        string
+	path       string // where a local source is read from, the url is kept as written in the config
+	git        GitOptions
+	checksums  []Checksum
 	modifiers  []SourceModifier
+
+	stripComponents int
+	ignore          []string
+	treeHash        string
+
+	license  string
+	homepage string
+}
+
+type GitOptions struct {
+	commit     string
+	tag        string
+	branch     string
+	depth      int
+	submodules bool
 }
 
 type CommonTarget struct {
@@ -69,6 +126,21 @@ type CommonTarget struct {
 type StandardTarget CommonTarget
 type HostTarget CommonTarget
 
+// display names the target along with its version, if it has one
+func (target *Target) display() string {
+	if target.version == "" {
+		return target.tag.ToString()
+	}
+	return fmt.Sprintf("%s (%s)", target.tag.ToString(), target.version)
+}
+
+// PhaseError describes the command that made a target fail and the phase it was run in
+type PhaseError struct {
+	phase string
+	cmd   string
+	err   error
+}
+
 type ExecMount struct {
 	name string
 	from string
@@ -86,9 +158,17 @@ type ExecContext struct {
 }
 
 func main() {
+	if !run() {
+		os.Exit(1)
+	}
+}
+
+// run runs the command the arguments ask for and reports whether it succeeded
+func run() bool {
 	ChariotContainer.HostInit()
 
 	cli := ChariotCLI.CreateCLI(os.Stdout)
+	defer cli.Reset()
 	cli.Println("Chariot")
 
 	cwd, err := os.Getwd()
@@ -98,119 +178,260 @@ func main() {
 
 	config := flag.String("config", "chariot.toml", "Path to the config file")
 	cache := flag.String("cache", filepath.Join(cwd, ".chariot-cache"), "Path to the cache directory")
+	distfiles := flag.String("distfiles", "", "Path to the directory downloaded archives are kept in, overrides the project config")
 	resetContainer := flag.Bool("reset-container", false, "Create a new container")
 	verbose := flag.Bool("verbose", false, "Turn on stdout logging")
 	quiet := flag.Bool("quiet", false, "Turn off stderr logs")
 	threads := flag.Uint("threads", 8, "Number of simultaneous threads to use")
+	jobs := flag.Uint("jobs", 1, "Number of targets to build simultaneously")
+	keepGoing := flag.Bool("keep-going", false, "Keep building targets that do not depend on a failed target")
+	dryRun := flag.Bool("dry-run", false, "Print what would be built and why without building anything")
+	incremental := flag.Bool("incremental", false, "Keep the build directories of rebuilt targets")
+	from := flag.String("from", "", "Phase (configure, build or install) to start explicitly requested targets from, implies an incremental build")
+	retries := flag.Uint("retries", 3, "Number of times a failed download is retried")
+	timeout := flag.Duration("timeout", 0, "Maximum time a single target may take to build, 0 means no limit")
+	output := flag.String("output", "", "Path the vendor command writes its bundle to (a directory or a .tar.gz tarball, defaults to vendor) or the sbom command writes its document to (defaults to sbom.spdx.json)")
+	vendor := flag.String("vendor", "", "Path to a bundle written by the vendor command to take sources from instead of upstream")
+	offline := flag.Bool("offline", false, "Never access the network, fail if something has not been fetched before")
+	profile := flag.String("profile", "", "Profile to apply to the config, every profile keeps its own builds in the cache")
+	noRebuildDependents := flag.Bool("no-rebuild-dependents", false, "Do not rebuild targets that depend on rebuilt targets")
 	flag.Parse()
 
 	ctx := &Context{
 		options: &Options{
-			cache:          *cache,
-			resetContainer: *resetContainer,
-			verbose:        *verbose,
-			quiet:          *quiet,
-			threads:        *threads,
+			cache:             *cache,
+			resetContainer:    *resetContainer,
+			verbose:           *verbose,
+			quiet:             *quiet,
+			threads:           *threads,
+			jobs:              *jobs,
+			rebuildDependents: !*noRebuildDependents,
+			keepGoing:         *keepGoing,
+			dryRun:            *dryRun,
+			incremental:       *incremental,
+			from:              *from,
+			timeout:           *timeout,
+			offline:           *offline,
 		},
-		cli:   cli,
-		cache: ChariotCache(*cache),
+		cli:        cli,
+		downloader: CreateDownloader(int(*retries), *offline),
 	}
 
-	cfg := ReadConfig(*config)
+	if ctx.options.from != "" && !ArrIncludes(PHASES, ctx.options.from) {
+		cli.Printf("Unknown phase %s\n", ctx.options.from)
+		return false
+	}
 
-	if !FileExists(ctx.cache.Path()) {
-		if err := os.MkdirAll(ctx.cache.Path(), DEFAULT_FILE_PERM); err != nil {
-			panic(err)
-		}
+	command := "build"
+	args := flag.Args()
+	if len(args) > 0 && ArrIncludes(COMMANDS, args[0]) {
+		command = args[0]
+		args = args[1:]
 	}
 
-	if !FileExists(filepath.Join(ctx.cache.Path(), "archlinux-bootstrap-x86_64.tar.zst")) {
-		cli.StartSpinner("Downloading arch linux image")
-		cmd := exec.Command("wget", "https://geo.mirror.pkgbuild.com/iso/latest/archlinux-bootstrap-x86_64.tar.zst")
-		cmd.Dir = ctx.cache.Path()
-		if err := cmd.Start(); err != nil {
-			cli.Println(err)
-			return
-		}
-		if err := cmd.Wait(); err != nil {
+	cfg, err := ReadConfig(*config)
+	if err != nil {
+		cli.Println(err)
+		return false
+	}
+	if *profile != "" {
+		if err := cfg.ApplyProfile(*profile); err != nil {
 			cli.Println(err)
-			return
+			return false
 		}
-		cli.StopSpinner()
 	}
-	if ctx.options.resetContainer {
-		ctx.wipeContainer()
+	if command == "validate" {
+		cli.Printf("%s is valid\n", *config)
+		return true
 	}
-	if !FileExists(ctx.cache.ContainerPath()) {
-		ctx.initContainer()
+
+	distfilesPath := *distfiles
+	if distfilesPath == "" && cfg.Project.Distfiles != "" {
+		distfilesPath = cfg.Project.Distfiles
+		if !filepath.IsAbs(distfilesPath) {
+			distfilesPath = filepath.Join(filepath.Dir(*config), distfilesPath)
+		}
 	}
+	ctx.cache = CreateCache(*cache, distfilesPath, *profile)
 
 	cli.Printf("Project: %s\n", cfg.Project.Name)
+	if *profile != "" {
+		cli.Printf("Profile: %s\n", *profile)
+	}
 	targets, err := cfg.BuildTargets(ctx)
 	if err != nil {
 		cli.Println(err)
-		return
+		return false
 	}
 	ctx.targets = targets
 
 	doTargets := make([]*Target, 0)
-	for _, stag := range flag.Args() {
+	for _, stag := range args {
 		tag, err := StringToTag(stag)
 		if err != nil {
 			cli.Println(err)
-			return
+			return false
 		}
 		found := false
 		for _, target := range targets {
 			if target.tag != tag {
 				continue
 			}
-			target.redo = true
+			// vendoring takes sources as they are, requesting a target only selects what to vendor
+			target.redo = command != "vendor"
 			doTargets = append(doTargets, target)
 			found = true
 		}
 		if !found {
 			cli.Printf("Unknown target %s\n", stag)
-			return
+			return false
+		}
+	}
+
+	if command == "report" {
+		if len(doTargets) == 0 {
+			doTargets = targets
+		}
+		ctx.printReport(doTargets)
+		return true
+	}
+
+	if command == "sbom" {
+		if len(doTargets) == 0 {
+			doTargets = targets
+		}
+		if *output == "" {
+			*output = "sbom.spdx.json"
+		}
+		if err := ctx.writeSbom(cfg.Project.Name, doTargets, *output); err != nil {
+			cli.Println(err)
+			return false
+		}
+		cli.Printf("Wrote SBOM to %s\n", *output)
+		return true
+	}
+
+	if command == "fetch" && ctx.options.offline {
+		cli.Println("Cannot fetch while offline")
+		return false
+	}
+
+	var vendorSources []*SourceTarget
+	if command == "vendor" {
+		if len(doTargets) == 0 {
+			doTargets = targets
+		}
+		if *output == "" {
+			*output = "vendor"
+		}
+		doTargets = slices.DeleteFunc(dependencyOrder(doTargets), func(target *Target) bool {
+			return target.source == nil
+		})
+		for _, target := range doTargets {
+			vendorSources = append(vendorSources, target.source)
+		}
+		// only the sources themselves have to be prepared, not whatever was built from them
+		ctx.options.rebuildDependents = false
+	}
+
+	var plan []PlanEntry
+	if command == "build" || command == "vendor" {
+		plan = ctx.plan(doTargets)
+		if ctx.options.dryRun {
+			ctx.printPlan(plan)
+			return true
+		}
+	}
+
+	if !FileExists(ctx.cache.Path()) {
+		if err := os.MkdirAll(ctx.cache.Path(), DEFAULT_FILE_PERM); err != nil {
+			panic(err)
+		}
+	}
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// a second interrupt should not be swallowed while the first one is being cleaned up after
+		<-runCtx.Done()
+		stop()
+	}()
+
+	if command == "fetch" {
+		if len(doTargets) == 0 {
+			doTargets = targets
+		}
+		if err := ctx.cache.Init(); err != nil {
+			cli.Println(err)
+			return false
+		}
+		if err := ctx.fetchSources(runCtx, doTargets); err != nil {
+			cli.Println(err)
+			return false
+		}
+		return true
+	}
+
+	// offline it is only needed for a container that cannot be initialized anyway
+	if !ctx.options.offline && !FileExists(filepath.Join(ctx.cache.Path(), "archlinux-bootstrap-x86_64.tar.zst")) {
+		if err := ctx.downloadBootstrap(runCtx); err != nil {
+			cli.Println(err)
+			return false
+		}
+	}
+	if ctx.options.resetContainer {
+		if ctx.options.offline {
+			cli.Println("Cannot reset the container while offline")
+			return false
+		}
+		ctx.wipeContainer()
+	}
+	if !FileExists(ctx.cache.ContainerPath()) {
+		if err := ctx.initContainer(runCtx); err != nil {
+			cli.Println(err)
+			return false
 		}
 	}
 
 	if err := ctx.cache.Init(); err != nil {
 		cli.Println(err)
-		return
+		return false
 	}
 
-	for _, target := range targets {
-		if target.tag.kind == "source" {
-			if FileExists(ctx.cache.SourcePath(target.tag.id)) {
-				target.built = true
-			}
-			continue
-		}
-		if FileExists(ctx.cache.BuiltPath(target.tag.id, target.tag.kind == "host")) {
-			target.built = true
+	if *vendor != "" {
+		bundle, err := OpenVendorBundle(*vendor, ctx.cache)
+		if err != nil {
+			cli.Println(err)
+			return false
 		}
+		ctx.vendor = bundle
+	}
+
+	if err := ctx.schedule(runCtx, plan); err != nil {
+		cli.Println(err)
+		return false
 	}
 
-	for _, target := range doTargets {
-		if err := ctx.do(target); err != nil {
+	if command == "vendor" {
+		if err := ctx.vendorSources(vendorSources, *output); err != nil {
 			cli.Println(err)
-			return
+			return false
 		}
+		cli.Printf("Vendored %d source(s) to %s\n", len(vendorSources), *output)
 	}
+	return true
 }
 
-func (ctx *Context) makeExecContext(cwd string, mounts []ExecMount, containerDeps []*Target) (*ExecContext, error) {
-	if err := os.RemoveAll(ctx.cache.HostPath()); err != nil {
-		return nil, err
-	}
-	if err := os.RemoveAll(ctx.cache.SysrootPath()); err != nil {
+func (ctx *Context) makeExecContext(target *Target, cwd string, mounts []ExecMount, containerDeps []*Target) (*ExecContext, error) {
+	hostPath := ctx.cache.HostPath(target.tag)
+	sysrootPath := ctx.cache.SysrootPath(target.tag)
+	if err := ctx.removeRoots(target.tag); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(ctx.cache.HostPath(), DEFAULT_FILE_PERM); err != nil {
+	if err := os.MkdirAll(hostPath, DEFAULT_FILE_PERM); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(ctx.cache.SysrootPath(), DEFAULT_FILE_PERM); err != nil {
+	if err := os.MkdirAll(sysrootPath, DEFAULT_FILE_PERM); err != nil {
 		return nil, err
 	}
 
@@ -234,11 +455,11 @@ func (ctx *Context) makeExecContext(cwd string, mounts []ExecMount, containerDep
 
 			switch dep.tag.kind {
 			case "host":
-				if err := CopyDirectory(filepath.Join(ctx.cache.BuiltPath(dep.tag.id, true), "usr", "local"), ctx.cache.HostPath()); err != nil {
+				if err := CopyDirectory(filepath.Join(ctx.cache.BuiltPath(dep.tag.id, true), "usr", "local"), hostPath); err != nil {
 					return err
 				}
 			case "":
-				if err := CopyDirectory(ctx.cache.BuiltPath(dep.tag.id, false), ctx.cache.SysrootPath()); err != nil {
+				if err := CopyDirectory(ctx.cache.BuiltPath(dep.tag.id, false), sysrootPath); err != nil {
 					return err
 				}
 			}
@@ -256,18 +477,19 @@ func (ctx *Context) makeExecContext(cwd string, mounts []ExecMount, containerDep
 		{name: "THREADS", value: fmt.Sprint(ctx.options.threads)},
 		{name: "PREFIX", value: "/usr/local"},
 		{name: "ROOT", value: "/chariot/root"},
+		{name: "VERSION", value: target.version},
 	}
 
-	for _, target := range state {
-		if target.tag.kind != "source" {
+	for _, dep := range state {
+		if dep.tag.kind != "source" {
 			continue
 		}
-		vars = append(vars, ExecVar{name: fmt.Sprintf("SOURCE:%s", target.tag.id), value: fmt.Sprintf("/chariot/sources/%s", target.tag.id)})
+		vars = append(vars, ExecVar{name: fmt.Sprintf("SOURCE:%s", dep.tag.id), value: fmt.Sprintf("/chariot/sources/%s", dep.tag.id)})
 	}
 
 	containerMounts := []ChariotContainer.Mount{
-		{To: "/usr/local", From: ctx.cache.HostPath()},
-		{To: "/chariot/root", From: ctx.cache.SysrootPath()},
+		{To: "/usr/local", From: hostPath},
+		{To: "/chariot/root", From: sysrootPath},
 		{To: "/chariot/sources", From: ctx.cache.SourcesPath()},
 	}
 	for _, mount := range mounts {
@@ -275,19 +497,88 @@ func (ctx *Context) makeExecContext(cwd string, mounts []ExecMount, containerDep
 		containerMounts = append(containerMounts, ChariotContainer.Mount{To: mount.to, From: mount.from})
 	}
 
-	verboseWriter, errorWriter := ctx.writers()
+	// user variables come last so they can use the built-in ones, project wide ones are overridden by
+	// those of the target
+	userVars := make(map[string]string)
+	for name, value := range ctx.vars {
+		userVars[name] = value
+	}
+	for name, value := range target.vars {
+		userVars[name] = value
+	}
+	builtins := len(vars)
+	for _, name := range sortedKeys(userVars) {
+		vars = append(vars, ExecVar{name: name, value: userVars[name]})
+	}
+	// user variables can refer to each other, a variable that refers to itself stops this eventually
+	for i := 0; i <= len(userVars); i++ {
+		changed := false
+		for j := builtins; j < len(vars); j++ {
+			if value := substituteVars(vars, vars[j].value); value != vars[j].value {
+				vars[j].value = value
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	env := make([]string, 0)
+	for _, name := range sortedKeys(target.env) {
+		env = append(env, fmt.Sprintf("%s=%s", name, substituteVars(vars, target.env[name])))
+	}
+
+	verboseWriter, errorWriter := ctx.writers(target)
 	execCtx := ExecContext{
-		chariotCtx: ChariotContainer.Use(ctx.cache.ContainerPath(), cwd, containerMounts, verboseWriter, errorWriter),
+		chariotCtx: ChariotContainer.Use(ctx.cache.ContainerPath(), cwd, containerMounts, env, verboseWriter, errorWriter),
 		vars:       vars,
 	}
 	return &execCtx, nil
 }
 
-func (ctx *ExecContext) exec(cmd string) error {
-	for _, v := range ctx.vars {
-		cmd = strings.ReplaceAll(cmd, fmt.Sprintf("$%s", v.name), v.value)
+// removeRoots deletes the host and system roots that were assembled for the target
+func (ctx *Context) removeRoots(tag Tag) error {
+	if err := os.RemoveAll(ctx.cache.HostPath(tag)); err != nil {
+		return err
+	}
+	return os.RemoveAll(ctx.cache.SysrootPath(tag))
+}
+
+func (ctx *ExecContext) exec(runCtx context.Context, cmd string) error {
+	return ctx.chariotCtx.Exec(runCtx, substituteVars(ctx.vars, cmd))
+}
+
+// substituteVars replaces every $NAME in str in a single pass, longer names are matched first so that
+// $CFLAGS does not eat into $CFLAGS_EXTRA
+func substituteVars(vars []ExecVar, str string) string {
+	sorted := slices.Clone(vars)
+	slices.SortStableFunc(sorted, func(a ExecVar, b ExecVar) int {
+		return len(b.name) - len(a.name)
+	})
+
+	pairs := make([]string, 0)
+	for _, v := range sorted {
+		pairs = append(pairs, fmt.Sprintf("$%s", v.name), v.value)
+	}
+	return strings.NewReplacer(pairs...).Replace(str)
+}
+
+func (err *PhaseError) Error() string {
+	return fmt.Sprintf("%s failed (%s): %s", err.phase, err.cmd, err.err)
+}
+
+func (err *PhaseError) Unwrap() error {
+	return err.err
+}
+
+// asPhaseError wraps err in a PhaseError unless it already tells which phase failed
+func asPhaseError(phase string, cmd string, err error) error {
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		return err
 	}
-	return ctx.chariotCtx.Exec(cmd)
+	return &PhaseError{phase: phase, cmd: cmd, err: err}
 }
 
 func (ctx *Context) wipeContainer() {
@@ -308,69 +599,107 @@ func (ctx *Context) wipeContainer() {
 	}
 }
 
-func (ctx *Context) initContainer() {
+func (ctx *Context) initContainer(runCtx context.Context) (err error) {
+	// pacman installs the packages the container needs from the mirrors
+	if ctx.options.offline {
+		return fmt.Errorf("no container at %s, it cannot be initialized while offline", ctx.cache.ContainerPath())
+	}
+
+	// a partially initialized container would be mistaken for a working one
+	defer func() {
+		if err != nil && FileExists(ctx.cache.ContainerPath()) {
+			ctx.wipeContainer()
+		}
+	}()
+
 	ctx.cli.StartSpinner("Initializing container")
 	defer ctx.cli.StopSpinner()
 
 	if _, err := os.Stat(filepath.Join(ctx.cache.Path(), "archlinux-bootstrap-x86_64.tar.zst")); err != nil {
-		ctx.cli.SetSpinnerMessage("Downloading arch linux image")
-		cmd := exec.Command("wget", "https://geo.mirror.pkgbuild.com/iso/latest/archlinux-bootstrap-x86_64.tar.zst")
-		cmd.Dir = ctx.cache.Path()
-		if err := cmd.Start(); err != nil {
-			panic(err)
-		}
-		if err := cmd.Wait(); err != nil {
-			panic(err)
+		if err := ctx.downloadBootstrap(runCtx); err != nil {
+			return err
 		}
 	}
 
 	ctx.cli.SetSpinnerMessage("Extracting arch linux image")
-	cmd := exec.Command("tar", "--zstd", "-xvf", "archlinux-bootstrap-x86_64.tar.zst")
+	cmd := exec.CommandContext(runCtx, "tar", "--zstd", "-xvf", "archlinux-bootstrap-x86_64.tar.zst")
 	cmd.Dir = ctx.cache.Path()
 	if err := cmd.Start(); err != nil {
-		panic(err)
+		return err
 	}
 	if err := cmd.Wait(); err != nil {
-		panic(err)
+		os.RemoveAll(filepath.Join(ctx.cache.Path(), "root.x86_64"))
+		return err
 	}
 
-	cmd = exec.Command("mv", "root.x86_64", "container")
+	cmd = exec.CommandContext(runCtx, "mv", "root.x86_64", "container")
 	cmd.Dir = ctx.cache.Path()
 	if err := cmd.Start(); err != nil {
-		panic(err)
+		return err
 	}
 	if err := cmd.Wait(); err != nil {
-		panic(err)
+		return err
 	}
 
 	ctx.cli.SetSpinnerMessage("Rewriting container permissions")
-	cmd = exec.Command("sh", "-c", "for f in $(find ./container -perm 000 2> /dev/null); do chmod 755 \"$f\"; done")
+	cmd = exec.CommandContext(runCtx, "sh", "-c", "for f in $(find ./container -perm 000 2> /dev/null); do chmod 755 \"$f\"; done")
 	cmd.Dir = ctx.cache.Path()
 	if err := cmd.Start(); err != nil {
-		panic(err)
+		return err
 	}
 	if err := cmd.Wait(); err != nil {
-		panic(err)
+		return err
 	}
 
 	ctx.cli.SetSpinnerMessage("Running initialization commands")
-	verboseWriter, _ := ctx.writers()
-	execContext := ChariotContainer.Use(ctx.cache.ContainerPath(), "/root", []ChariotContainer.Mount{}, verboseWriter, verboseWriter)
-	execContext.Exec("echo 'Server = https://geo.mirror.pkgbuild.com/$repo/os/$arch' > /etc/pacman.d/mirrorlist")
-	execContext.Exec("echo 'Server = https://mirror.rackspace.com/archlinux/$repo/os/$arch' >> /etc/pacman.d/mirrorlist")
-	execContext.Exec("echo 'Server = https://mirror.leaseweb.net/archlinux/$repo/os/$arch' >> /etc/pacman.d/mirrorlist")
-	execContext.Exec("echo 'en_US.UTF-8 UTF-8' > /etc/locale.gen")
-	execContext.Exec("locale-gen")
-	execContext.Exec("pacman-key --init")
-	execContext.Exec("pacman-key --populate archlinux")
-	execContext.Exec("pacman --noconfirm -Sy archlinux-keyring")
-	execContext.Exec("pacman --noconfirm -S pacman pacman-mirrorlist")
-	execContext.Exec("pacman --noconfirm -Syu")
-	execContext.Exec("pacman --noconfirm -S ninja meson git wget perl diffutils inetutils python help2man bison flex gettext libtool m4 make patch texinfo which binutils gcc gcc-fortran nasm rsync")
+	verboseWriter, _ := ctx.writers(nil)
+	execContext := ChariotContainer.Use(ctx.cache.ContainerPath(), "/root", []ChariotContainer.Mount{}, nil, verboseWriter, verboseWriter)
+	execContext.Exec(runCtx, "echo 'Server = https://geo.mirror.pkgbuild.com/$repo/os/$arch' > /etc/pacman.d/mirrorlist")
+	execContext.Exec(runCtx, "echo 'Server = https://mirror.rackspace.com/archlinux/$repo/os/$arch' >> /etc/pacman.d/mirrorlist")
+	execContext.Exec(runCtx, "echo 'Server = https://mirror.leaseweb.net/archlinux/$repo/os/$arch' >> /etc/pacman.d/mirrorlist")
+	execContext.Exec(runCtx, "echo 'en_US.UTF-8 UTF-8' > /etc/locale.gen")
+	execContext.Exec(runCtx, "locale-gen")
+	execContext.Exec(runCtx, "pacman-key --init")
+	execContext.Exec(runCtx, "pacman-key --populate archlinux")
+	execContext.Exec(runCtx, "pacman --noconfirm -Sy archlinux-keyring")
+	execContext.Exec(runCtx, "pacman --noconfirm -S pacman pacman-mirrorlist")
+	execContext.Exec(runCtx, "pacman --noconfirm -Syu")
+	execContext.Exec(runCtx, "pacman --noconfirm -S ninja meson git wget perl diffutils inetutils python help2man bison flex gettext libtool m4 make patch texinfo which binutils gcc gcc-fortran nasm rsync")
+	return runCtx.Err()
+}
+
+// downloadBootstrap fetches the arch linux image the container is created from
+func (ctx *Context) downloadBootstrap(runCtx context.Context) error {
+	task := ctx.cli.StartTask("Downloading arch linux image")
+	defer task.Stop()
+
+	return ctx.downloader.Download(runCtx, "arch linux image", "https://geo.mirror.pkgbuild.com/iso/latest/archlinux-bootstrap-x86_64.tar.zst",
+		filepath.Join(ctx.cache.Path(), "archlinux-bootstrap-x86_64.tar.zst"), downloadProgress(task, "Downloading arch linux image"))
 }
 
-func (ctx *Context) writers() (io.Writer, io.Writer) {
+// downloadProgress returns a progress callback for the downloader that shows the progress on the task
+func downloadProgress(task *ChariotCLI.Task, message string) func(done int64, total int64) {
+	return func(done int64, total int64) {
+		if total < 0 {
+			task.SetMessage("%s (%s)", message, ChariotCLI.FormatBytes(done))
+			return
+		}
+		task.SetMessage("%s (%s / %s)", message, ChariotCLI.FormatBytes(done), ChariotCLI.FormatBytes(total))
+	}
+}
+
+func (ctx *Context) writers(target *Target) (io.Writer, io.Writer) {
 	var verboseWriter, errWriter io.Writer = nil, nil
+	if target != nil && (target.verboseWriter != nil || target.errWriter != nil) {
+		// a nil pointer in an interface would not be recognized as no writer
+		if target.verboseWriter != nil {
+			verboseWriter = target.verboseWriter
+		}
+		if target.errWriter != nil {
+			errWriter = target.errWriter
+		}
+		return verboseWriter, errWriter
+	}
 	if ctx.options.verbose {
 		verboseWriter = ctx.cli.GetWriter(false, ChariotCLI.LIGHT_GRAY)
 	}
@@ -380,42 +709,47 @@ func (ctx *Context) writers() (io.Writer, io.Writer) {
 	return verboseWriter, errWriter
 }
 
-func (ctx *Context) do(target *Target) error {
-	if target.touched {
-		return nil
+// startOutput gives the target writers of its own, so that the lines of targets that are built at the
+// same time are not mixed up. They are prefixed with the target when more than one job is running.
+func (ctx *Context) startOutput(target *Target) {
+	prefix := ""
+	if ctx.options.jobs > 1 {
+		prefix = fmt.Sprintf("[%s] ", target.tag.ToString())
 	}
-	target.touched = true
-
-	for _, dep := range append(target.dependencies, target.runtimeDependencies...) {
-		if err := ctx.do(dep); err != nil {
-			return err
-		}
+	if ctx.options.verbose {
+		target.verboseWriter = ctx.cli.GetPrefixedWriter(false, ChariotCLI.LIGHT_GRAY, prefix)
 	}
-
-	if target.built && !target.redo {
-		return nil
+	if !ctx.options.quiet {
+		target.errWriter = ctx.cli.GetPrefixedWriter(true, ChariotCLI.LIGHT_RED, prefix)
 	}
-	target.redo = false
+}
 
-	ctx.cli.Printf(">> %s\n", target.tag.ToString())
-	return target.do()
+// stopOutput writes out what is left in the writers of the target
+func (ctx *Context) stopOutput(target *Target) {
+	for _, writer := range []*ChariotCLI.CLIWriter{target.verboseWriter, target.errWriter} {
+		if writer != nil {
+			writer.Flush()
+		}
+	}
+	target.verboseWriter, target.errWriter = nil, nil
 }
 
-func (ctx *Context) makeSourceDoer(source *SourceTarget) func() error {
-	return func() (err error) {
+func (ctx *Context) makeSourceDoer(source *SourceTarget) func(runCtx context.Context) error {
+	return func(runCtx context.Context) (err error) {
 		sourcePath := ctx.cache.SourcePath(source.tag.id)
 
 		if FileExists(sourcePath) {
 			if err := os.RemoveAll(sourcePath); err != nil {
-				return err
+				return &PhaseError{phase: "prepare", cmd: sourcePath, err: err}
 			}
 		}
 
-		ctx.cli.StartSpinner("Initializing source %s", source.tag.ToString())
-		defer ctx.cli.StopSpinner()
+		task := ctx.cli.StartTask("Initializing source %s", source.tag.ToString())
+		defer task.Stop()
+		defer ctx.removeRoots(source.tag)
 
 		if err := os.MkdirAll(sourcePath, DEFAULT_FILE_PERM); err != nil {
-			return err
+			return &PhaseError{phase: "prepare", cmd: sourcePath, err: err}
 		}
 		defer func() {
 			if err != nil {
@@ -423,132 +757,221 @@ func (ctx *Context) makeSourceDoer(source *SourceTarget) func() error {
 			}
 		}()
 
-		ctx.cli.SetSpinnerMessage("Fetching %s", source.tag.ToString())
-		var cmd *exec.Cmd
-		switch source.sourceType {
-		case "tar.gz":
-			cmd = exec.Command("sh", "-c", fmt.Sprintf("wget -qO- %s | tar --strip-components 1 -xvz -C %s", source.url, sourcePath))
-		case "tar.xz":
-			cmd = exec.Command("sh", "-c", fmt.Sprintf("wget -qO- %s | tar --strip-components 1 -xvJ -C %s", source.url, sourcePath))
-		case "local":
-			cmd = exec.Command("cp", "-r", "-T", source.url, sourcePath)
-		default:
-			return fmt.Errorf("source %s has an invalid type (%s)", source.tag.ToString(), source.sourceType)
-		}
-		if err := cmd.Start(); err != nil {
-			return err
+		start := time.Now()
+		if vendored, err := ctx.copyVendored(source, sourcePath); vendored {
+			if err != nil {
+				return &PhaseError{phase: "fetch", cmd: source.url, err: err}
+			}
+			// the bundle holds the sources with their modifiers already applied
+			source.record("vendor", start)
+			return nil
 		}
-		if err := cmd.Wait(); err != nil {
-			return err
+
+		task.SetMessage("Fetching %s", source.tag.ToString())
+		switch {
+		case slices.Contains(ARCHIVE_TYPES, source.sourceType):
+			archivePath, err := ctx.fetchArchive(runCtx, task, source)
+			if err != nil {
+				return asPhaseError("fetch", source.url, err)
+			}
+
+			task.SetMessage("Extracting %s", source.tag.ToString())
+			if err := ExtractArchive(archivePath, source.sourceType, sourcePath, source.stripComponents, UrlBase(source.url)); err != nil {
+				return &PhaseError{phase: "extract", cmd: source.url, err: err}
+			}
+		case source.sourceType == "local":
+			if err := CopyTree(source.path, sourcePath, source.ignore); err != nil {
+				return &PhaseError{phase: "fetch", cmd: source.path, err: err}
+			}
+		case source.sourceType == "git":
+			if err := ctx.fetchGit(runCtx, source, sourcePath); err != nil {
+				return asPhaseError("fetch", source.url, err)
+			}
+		default:
+			return &PhaseError{phase: "fetch", cmd: source.url, err: fmt.Errorf("invalid source type %s", source.sourceType)}
 		}
+		source.record("fetch", start)
 
-		ctx.cli.SetSpinnerMessage("Applying source modifications %s", source.tag.ToString())
-		for _, modifier := range source.modifiers {
+		task.SetMessage("Applying source modifications %s", source.tag.ToString())
+		for i, modifier := range source.modifiers {
+			start := time.Now()
+			step := fmt.Sprintf("modifier %d (%s)", i+1, modifier.modifierType)
+			var cmd *exec.Cmd
 			modSourcePath := ""
 			if modifier.source != nil {
 				modSourcePath = ctx.cache.SourcePath(modifier.source.tag.id)
 			}
 			switch modifier.modifierType {
 			case "patch":
-				if modSourcePath == "" {
-					return fmt.Errorf("patch modifier requires source")
+				// patches without a source were resolved against the config that declares them
+				patchPath := modifier.path
+				if modSourcePath != "" {
+					patchPath = filepath.Join(modSourcePath, modifier.file)
+				}
+				if !FileExists(patchPath) {
+					return &PhaseError{phase: "modify", cmd: patchPath, err: fmt.Errorf("patch %s does not exist", patchPath)}
 				}
-				if !FileExists(filepath.Join(modSourcePath, modifier.file)) {
-					return fmt.Errorf("patch %s does not exist in source %s", modifier.file, modifier.source.tag.id)
+				cmd = exec.CommandContext(runCtx, "patch", fmt.Sprintf("-p%d", modifier.strip), "-i", patchPath)
+			case "patches":
+				seriesPath := modifier.path
+				if modSourcePath != "" {
+					seriesPath = filepath.Join(modSourcePath, modifier.file)
+				}
+				series, err := readSeries(seriesPath, modifier.strip)
+				if err != nil {
+					return &PhaseError{phase: "modify", cmd: modifier.file, err: err}
 				}
-				cmd = exec.Command("patch", "-p1", "-i", filepath.Join(modSourcePath, modifier.file))
+				for _, entry := range series {
+					task.SetMessage("Applying %s to %s", filepath.Base(entry.path), source.tag.ToString())
+					if err := ctx.applyPatch(runCtx, source.Target, sourcePath, entry.path, entry.strip, modifier.allowFuzz); err != nil {
+						return asPhaseError("modify", entry.path, err)
+					}
+				}
+				source.record(step, start)
+				continue
 			case "merge":
 				if modSourcePath == "" {
-					return fmt.Errorf("merge modifier requires source")
+					return &PhaseError{phase: "modify", cmd: step, err: fmt.Errorf("merge modifier requires source")}
 				}
-				cmd = exec.Command("cp", "-r", fmt.Sprintf("%s/.", modSourcePath), ".")
+				cmd = exec.CommandContext(runCtx, "cp", "-r", fmt.Sprintf("%s/.", modSourcePath), ".")
 			case "exec":
-				execContext, err := ctx.makeExecContext("/chariot/source", []ExecMount{
+				execContext, err := ctx.makeExecContext(source.Target, "/chariot/source", []ExecMount{
 					{name: "SOURCE", to: "/chariot/source", from: sourcePath},
-				}, append(source.dependencies, source.runtimeDependencies...))
+				}, source.allDependencies())
 				if err != nil {
-					return err
+					return &PhaseError{phase: "modify", cmd: modifier.cmd, err: err}
 				}
 
-				if err := execContext.exec(modifier.cmd); err != nil {
-					return err
+				if err := execContext.exec(runCtx, modifier.cmd); err != nil {
+					return &PhaseError{phase: "modify", cmd: modifier.cmd, err: err}
 				}
+				source.record(step, start)
 				continue
 			default:
-				return fmt.Errorf("source %s has an invalid (%s)", source.tag.ToString(), modifier.modifierType)
+				return &PhaseError{phase: "modify", cmd: step, err: fmt.Errorf("invalid modifier type %s", modifier.modifierType)}
 			}
 			cmd.Dir = sourcePath
 			if err := cmd.Start(); err != nil {
-				return err
+				return &PhaseError{phase: "modify", cmd: cmd.String(), err: err}
 			}
 			if err := cmd.Wait(); err != nil {
-				return err
+				return &PhaseError{phase: "modify", cmd: cmd.String(), err: err}
 			}
+			source.record(step, start)
 		}
 
 		return nil
 	}
 }
 
-func (ctx *Context) makeCommonTarget(target *CommonTarget, host bool) func() error {
-	return func() (err error) {
+// fetchArchive makes sure the archive of a source is in the distfiles and matches the checksums of the
+// source, only downloading it when it is not there yet
+func (ctx *Context) fetchArchive(runCtx context.Context, task *ChariotCLI.Task, source *SourceTarget) (string, error) {
+	archivePath := ctx.cache.DistfilePath(source.url, source.checksums)
+	unlock, err := ctx.downloader.lock(runCtx, archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if FileExists(archivePath) {
+		if err := VerifyChecksums(archivePath, source.checksums); err == nil {
+			return archivePath, nil
+		}
+		// a corrupted distfile is not worth failing over, it is simply downloaded again
+		if err := os.Remove(archivePath); err != nil {
+			return "", err
+		}
+	}
+
+	message := fmt.Sprintf("Fetching %s", source.tag.ToString())
+	if err := ctx.downloader.Download(runCtx, source.tag.ToString(), source.url, archivePath, downloadProgress(task, message)); err != nil {
+		return "", &PhaseError{phase: "fetch", cmd: source.url, err: err}
+	}
+
+	if err := VerifyChecksums(archivePath, source.checksums); err != nil {
+		os.Remove(archivePath)
+		return "", &PhaseError{phase: "verify", cmd: source.url, err: err}
+	}
+	return archivePath, nil
+}
+
+func (ctx *Context) makeCommonTarget(target *CommonTarget, host bool) func(runCtx context.Context) error {
+	return func(runCtx context.Context) (err error) {
 		buildDir := ctx.cache.BuildPath(target.tag.id, host)
 		builtDir := ctx.cache.BuiltPath(target.tag.id, host)
 
-		if FileExists(buildDir) {
+		// incremental builds reuse the previous build directory, only the install output is redone
+		incremental := (ctx.options.incremental || (target.redo && ctx.options.from != "")) && FileExists(buildDir)
+		from := PHASES[0]
+		if incremental && target.redo && ctx.options.from != "" {
+			from = ctx.options.from
+		}
+
+		if FileExists(buildDir) && !incremental {
 			if err := os.RemoveAll(buildDir); err != nil {
-				return err
+				return &PhaseError{phase: "prepare", cmd: buildDir, err: err}
 			}
 		}
 		if FileExists(builtDir) {
 			if err := os.RemoveAll(builtDir); err != nil {
-				return err
+				return &PhaseError{phase: "prepare", cmd: builtDir, err: err}
 			}
 		}
 
-		ctx.cli.StartSpinner("Preparing %s", target.tag.ToString())
-		defer ctx.cli.StopSpinner()
+		task := ctx.cli.StartTask("Preparing %s", target.tag.ToString())
+		defer task.Stop()
+		defer ctx.removeRoots(target.tag)
 
 		if err := os.MkdirAll(buildDir, DEFAULT_FILE_PERM); err != nil {
-			return err
+			return &PhaseError{phase: "prepare", cmd: buildDir, err: err}
 		}
 		if err := os.MkdirAll(builtDir, DEFAULT_FILE_PERM); err != nil {
-			return err
+			return &PhaseError{phase: "prepare", cmd: builtDir, err: err}
 		}
 		defer func() {
 			if err != nil {
-				os.RemoveAll(buildDir)
+				if !incremental {
+					os.RemoveAll(buildDir)
+				}
 				os.RemoveAll(builtDir)
 			}
 		}()
 
-		execContext, err := ctx.makeExecContext("/chariot/build", []ExecMount{
+		execContext, err := ctx.makeExecContext(target.Target, "/chariot/build", []ExecMount{
 			{name: "BUILD", to: "/chariot/build", from: buildDir},
 			{name: "INSTALL", to: "/chariot/install", from: builtDir},
-		}, append(target.dependencies, target.runtimeDependencies...))
+		}, target.allDependencies())
 		if err != nil {
-			return err
+			return &PhaseError{phase: "prepare", cmd: "assembling the roots of the dependencies", err: err}
 		}
 
-		ctx.cli.SetSpinnerMessage("Configuring %s", target.tag.ToString())
-		for _, cmd := range target.configure {
-			if err := execContext.exec(cmd); err != nil {
-				return err
-			}
+		phases := []struct {
+			name     string
+			message  string
+			commands []string
+		}{
+			{name: "configure", message: "Configuring", commands: target.configure},
+			{name: "build", message: "Building", commands: target.build},
+			{name: "install", message: "Installing", commands: target.install},
 		}
-
-		ctx.cli.SetSpinnerMessage("Building %s", target.tag.ToString())
-		for _, cmd := range target.build {
-			if err := execContext.exec(cmd); err != nil {
-				return err
+		started := false
+		for _, phase := range phases {
+			if phase.name == from {
+				started = true
+			}
+			if !started {
+				continue
 			}
-		}
 
-		ctx.cli.SetSpinnerMessage("Installing %s", target.tag.ToString())
-		for _, cmd := range target.install {
-			if err := execContext.exec(cmd); err != nil {
-				return err
+			task.SetMessage("%s %s", phase.message, target.tag.ToString())
+			start := time.Now()
+			for _, cmd := range phase.commands {
+				if err := execContext.exec(runCtx, cmd); err != nil {
+					return &PhaseError{phase: phase.name, cmd: cmd, err: err}
+				}
 			}
+			target.record(phase.name, start)
 		}
 
 		return nil
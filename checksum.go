@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+type Checksum struct {
+	algorithm string
+	value     string
+}
+
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b":
+		return blake2b.New512(nil)
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm (%s)", algorithm)
+	}
+}
+
+// VerifyChecksums hashes the file once with every algorithm that has an expected checksum and fails
+// on the first mismatch
+func VerifyChecksums(path string, checksums []Checksum) error {
+	if len(checksums) == 0 {
+		return nil
+	}
+
+	hashes := make([]hash.Hash, 0)
+	writers := make([]io.Writer, 0)
+	for _, checksum := range checksums {
+		h, err := newChecksumHash(checksum.algorithm)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h)
+		writers = append(writers, h)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return err
+	}
+
+	for i, checksum := range checksums {
+		actual := hex.EncodeToString(hashes[i].Sum(nil))
+		if !strings.EqualFold(actual, checksum.value) {
+			return fmt.Errorf("%s checksum mismatch, expected %s but got %s", checksum.algorithm, checksum.value, actual)
+		}
+	}
+	return nil
+}
+
+// fileChecksum computes the checksum of a file with one of the supported algorithms
+func fileChecksum(path string, algorithm string) (string, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
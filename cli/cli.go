@@ -1,8 +1,10 @@
 package chariot_cli
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -35,16 +37,55 @@ type CLI struct {
 
 	doSpin  bool
 	spinner *spinner.Spinner
+	tasks   []*Task
+	main    *Task
 }
 
+type Task struct {
+	cli     *CLI
+	message string
+}
+
+// CLIWriter writes command output to the cli. A writer with a prefix keeps its own partial line and
+// only passes on whole lines, so writers used at the same time never splice their lines together.
 type CLIWriter struct {
-	cli   *CLI
-	err   bool
-	color string
+	cli    *CLI
+	err    bool
+	color  string
+	prefix string
+
+	lock sync.Mutex
+	buf  []byte
 }
 
 func (writer *CLIWriter) Write(buf []byte) (int, error) {
-	return writer.cli.write(buf, writer.color)
+	if writer.prefix == "" {
+		return writer.cli.write(buf, writer.color)
+	}
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	writer.buf = append(writer.buf, buf...)
+	for {
+		i := bytes.IndexByte(writer.buf, '\n')
+		if i < 0 {
+			break
+		}
+		writer.cli.write(append([]byte(writer.prefix), writer.buf[:i+1]...), writer.color)
+		writer.buf = writer.buf[i+1:]
+	}
+	return len(buf), nil
+}
+
+// Flush writes out whatever is left of an unfinished line
+func (writer *CLIWriter) Flush() {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if len(writer.buf) == 0 {
+		return
+	}
+	writer.cli.write(append(append([]byte(writer.prefix), writer.buf...), '\n'), writer.color)
+	writer.buf = nil
 }
 
 func CreateCLI(out io.Writer) *CLI {
@@ -88,26 +129,114 @@ func (cli *CLI) write(buf []byte, color string) (int, error) {
 }
 
 func (cli *CLI) GetWriter(err bool, color string) *CLIWriter {
+	return cli.GetPrefixedWriter(err, color, "")
+}
+
+// GetPrefixedWriter returns a writer that puts prefix in front of every line
+func (cli *CLI) GetPrefixedWriter(err bool, color string, prefix string) *CLIWriter {
 	return &CLIWriter{
-		cli:   cli,
-		err:   err,
-		color: color,
+		cli:    cli,
+		err:    err,
+		color:  color,
+		prefix: prefix,
 	}
 }
 
 func (cli *CLI) StartSpinner(format string, a ...any) {
-	cli.doSpin = true
-	cli.SetSpinnerMessage(format, a...)
-	cli.spinner.Start()
+	cli.main = cli.StartTask(format, a...)
 }
 
 func (cli *CLI) SetSpinnerMessage(format string, a ...any) {
-	cli.spinner.Suffix = fmt.Sprintf(" %s", fmt.Sprintf(format, a...))
+	if cli.main == nil {
+		return
+	}
+	cli.main.SetMessage(format, a...)
 }
 
 func (cli *CLI) StopSpinner() {
-	cli.doSpin = false
-	cli.spinner.Stop()
+	if cli.main == nil {
+		return
+	}
+	cli.main.Stop()
+	cli.main = nil
+}
+
+// StartTask adds a message to the spinner, starting the spinner if this is the only active task.
+// Tasks allow several concurrent jobs to report their progress at the same time.
+func (cli *CLI) StartTask(format string, a ...any) *Task {
+	task := &Task{cli: cli, message: fmt.Sprintf(format, a...)}
+
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	cli.tasks = append(cli.tasks, task)
+	cli.updateSpinner()
+	if !cli.doSpin {
+		cli.doSpin = true
+		cli.spinner.Start()
+	}
+	return task
+}
+
+func (task *Task) SetMessage(format string, a ...any) {
+	task.cli.lock.Lock()
+	defer task.cli.lock.Unlock()
+	task.message = fmt.Sprintf(format, a...)
+	task.cli.updateSpinner()
+}
+
+func (task *Task) Stop() {
+	cli := task.cli
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for i, t := range cli.tasks {
+		if t != task {
+			continue
+		}
+		cli.tasks = append(cli.tasks[:i], cli.tasks[i+1:]...)
+		break
+	}
+	cli.updateSpinner()
+	if len(cli.tasks) == 0 && cli.doSpin {
+		cli.doSpin = false
+		cli.spinner.Stop()
+	}
+}
+
+// Reset stops the spinner and drops every task, restoring the terminal
+func (cli *CLI) Reset() {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	cli.tasks = nil
+	cli.main = nil
+	if cli.doSpin {
+		cli.doSpin = false
+		cli.spinner.Stop()
+	}
+}
+
+// updateSpinner expects the cli lock to be held
+func (cli *CLI) updateSpinner() {
+	messages := make([]string, 0)
+	for _, task := range cli.tasks {
+		messages = append(messages, task.message)
+	}
+	cli.spinner.Lock()
+	cli.spinner.Suffix = fmt.Sprintf(" %s", strings.Join(messages, " | "))
+	cli.spinner.Unlock()
+}
+
+// FormatBytes formats a byte count with a binary unit, e.g. 12.3 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func (cli *CLI) Printf(format string, a ...any) {
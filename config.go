@@ -1,37 +1,77 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
-
-	"github.com/BurntSushi/toml"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
 type ConfigProject struct {
-	Name string
+	Name      string
+	Distfiles string
+	Vars      map[string]string
 }
 
 type ConfigTarget struct {
+	Version      string
 	Dependencies []string
+	Vars         map[string]string
+	Env          map[string]string
+
+	origin *configOrigin
 }
 
 type ConfigSourceTarget struct {
 	ConfigTarget
 
-	Type string
-	Url  string
+	Type            string
+	Url             string
+	StripComponents *int `toml:"strip-components"`
+	Ignore          []string
+
+	// metadata for the sbom, it does not influence the build
+	License  string `json:"-"`
+	Homepage string `json:"-"`
+
+	Sha256  string
+	Sha512  string
+	Blake2b string
+
+	Commit     string
+	Tag        string
+	Branch     string
+	Depth      int
+	Submodules bool
 
 	Modifiers []struct {
-		Type   string
-		Source string
-		File   string
-		Cmd    string
+		Type      string
+		Source    string
+		File      string
+		Cmd       string
+		Strip     *int
+		AllowFuzz bool `toml:"allow-fuzz"`
 	}
 }
 
+// ConfigAppend holds lists that are appended to the ones inherited from a template
+type ConfigAppend struct {
+	Dependencies        []string
+	RuntimeDependencies []string `toml:"runtime-dependencies"`
+	Configure           []string
+	Build               []string
+	Install             []string
+}
+
 type ConfigStandardTarget struct {
 	ConfigTarget
 
+	// both are resolved by ReadConfig, they are left out of the fingerprint as the lists they produce are in it
+	Extends string       `json:"-"`
+	Append  ConfigAppend `json:"-"`
+
 	Configure []string
 	Build     []string
 	Install   []string
@@ -42,33 +82,442 @@ type ConfigHostTarget struct {
 	RuntimeDependencies []string `toml:"runtime-dependencies"`
 }
 
+// ConfigProfileTarget overrides parts of a target while its profile is selected, lists that are not
+// set are kept and vars and env are overridden per key
+type ConfigProfileTarget struct {
+	Dependencies        *[]string
+	RuntimeDependencies *[]string `toml:"runtime-dependencies"`
+	Configure           *[]string
+	Build               *[]string
+	Install             *[]string
+	Vars                map[string]string
+	Env                 map[string]string
+
+	origin *configOrigin
+}
+
+type ConfigProfile struct {
+	Vars   map[string]string
+	Source map[string]ConfigProfileTarget
+	Host   map[string]ConfigProfileTarget
+	Target map[string]ConfigProfileTarget
+
+	origin *configOrigin
+}
+
 type Config struct {
-	Project ConfigProject
-	Source  map[string]ConfigSourceTarget
-	Host    map[string]ConfigHostTarget
-	Target  map[string]ConfigStandardTarget
+	Include  []string
+	Project  ConfigProject
+	Profile  map[string]ConfigProfile
+	Template map[string]ConfigHostTarget
+	Source   map[string]ConfigSourceTarget
+	Host     map[string]ConfigHostTarget
+	Target   map[string]ConfigStandardTarget
+
+	origin *configOrigin
 }
 
-func ReadConfig(path string) *Config {
-	data, err := os.ReadFile(path)
+// ReadConfig reads and validates the config at path along with everything it includes, reporting every
+// problem it finds at once
+func ReadConfig(path string) (*Config, error) {
+	errs := make(ConfigErrors, 0)
+	// decode keeps the errors of a file and carries on, only a file that cannot be read stops it
+	decode := func(path string, root bool) (*Config, error) {
+		cfg, err := decodeConfig(path, root)
+		var configErrs ConfigErrors
+		if errors.As(err, &configErrs) {
+			errs = append(errs, configErrs...)
+			return cfg, nil
+		}
+		return cfg, err
+	}
+
+	cfg, err := decode(path, true)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	// without the root config there is nothing to include or check against
+	if cfg == nil {
+		return nil, errs
+	}
+
+	included := map[string]bool{}
+	if abs, err := filepath.Abs(path); err == nil {
+		included[abs] = true
+	}
+
+	var include func(from *configOrigin, patterns []string) error
+	include = func(from *configOrigin, patterns []string) error {
+		for _, pattern := range patterns {
+			paths, err := filepath.Glob(from.resolve(pattern))
+			if err != nil {
+				return err
+			}
+			// an empty glob is fine (e.g. a packages directory without packages yet), a missing file is not
+			if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+				errs = append(errs, &ConfigError{file: from.path, line: from.lines.line([]string{"include"}), key: "include", message: fmt.Sprintf("%s does not match any file", pattern)})
+			}
+			for _, includePath := range paths {
+				// a file can be reached through more than one include, it is only read once
+				if included[includePath] {
+					continue
+				}
+				included[includePath] = true
+
+				includeCfg, err := decode(includePath, false)
+				if err != nil {
+					return err
+				}
+				if includeCfg == nil {
+					continue
+				}
+				errs = append(errs, cfg.merge(includeCfg)...)
+				if err := include(includeCfg.origin, includeCfg.Include); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := include(cfg.origin, cfg.Include); err != nil {
+		return nil, err
+	}
+
+	errs = append(errs, cfg.validateReferences()...)
+	errs = append(errs, cfg.resolveTemplates()...)
+	// cycles are only meaningful once every dependency is known
+	if len(errs) == 0 {
+		errs = append(errs, cfg.validateCycles()...)
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// patchHashes hashes a patch, or every patch of a series, so that editing them rebuilds the source
+func patchHashes(path string, series bool) ([]string, error) {
+	paths := []string{path}
+	if series {
+		entries, err := readSeries(path, 0)
+		if err != nil {
+			return nil, err
+		}
+		paths = paths[:0]
+		for _, entry := range entries {
+			paths = append(paths, entry.path)
+		}
+	}
+
+	hashes := make([]string, 0)
+	for _, path := range paths {
+		hash, err := fileChecksum(path, "sha256")
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, fmt.Sprintf("%s:%s", filepath.Base(path), hash))
+	}
+	return hashes, nil
+}
+
+// merge adds the targets of an included config, an id can only be defined once across all files
+func (cfg *Config) merge(other *Config) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	duplicate := func(key []string, origin *configOrigin, first *configOrigin) {
+		errs = append(errs, &ConfigError{
+			file:    origin.path,
+			line:    origin.lines.line(key),
+			key:     strings.Join(key, "."),
+			message: fmt.Sprintf("already defined at %s:%d", first.path, first.lines.line(key)),
+		})
+	}
+
+	for id, source := range other.Source {
+		if existing, ok := cfg.Source[id]; ok {
+			duplicate([]string{"source", id}, source.origin, existing.origin)
+			continue
+		}
+		if cfg.Source == nil {
+			cfg.Source = make(map[string]ConfigSourceTarget)
+		}
+		cfg.Source[id] = source
+	}
+	for id, host := range other.Host {
+		if existing, ok := cfg.Host[id]; ok {
+			duplicate([]string{"host", id}, host.origin, existing.origin)
+			continue
+		}
+		if cfg.Host == nil {
+			cfg.Host = make(map[string]ConfigHostTarget)
+		}
+		cfg.Host[id] = host
+	}
+	for id, target := range other.Target {
+		if existing, ok := cfg.Target[id]; ok {
+			duplicate([]string{"target", id}, target.origin, existing.origin)
+			continue
+		}
+		if cfg.Target == nil {
+			cfg.Target = make(map[string]ConfigStandardTarget)
+		}
+		cfg.Target[id] = target
+	}
+	for name, template := range other.Template {
+		if existing, ok := cfg.Template[name]; ok {
+			duplicate([]string{"template", name}, template.origin, existing.origin)
+			continue
+		}
+		if cfg.Template == nil {
+			cfg.Template = make(map[string]ConfigHostTarget)
+		}
+		cfg.Template[name] = template
+	}
+
+	// a profile can be spread over several files, as long as they do not override the same things
+	for name, profile := range other.Profile {
+		existing, ok := cfg.Profile[name]
+		if !ok {
+			if cfg.Profile == nil {
+				cfg.Profile = make(map[string]ConfigProfile)
+			}
+			cfg.Profile[name] = profile
+			continue
+		}
+		for _, varName := range sortedKeys(profile.Vars) {
+			if _, ok := existing.Vars[varName]; ok {
+				duplicate([]string{"profile", name, "vars", varName}, profile.origin, existing.origin)
+				continue
+			}
+			if existing.Vars == nil {
+				existing.Vars = make(map[string]string)
+			}
+			existing.Vars[varName] = profile.Vars[varName]
+		}
+		mergeTargets := func(kind string, targets map[string]ConfigProfileTarget, into *map[string]ConfigProfileTarget) {
+			for _, id := range sortedKeys(targets) {
+				if first, ok := (*into)[id]; ok {
+					duplicate([]string{"profile", name, kind, id}, targets[id].origin, first.origin)
+					continue
+				}
+				if *into == nil {
+					*into = make(map[string]ConfigProfileTarget)
+				}
+				(*into)[id] = targets[id]
+			}
+		}
+		mergeTargets("source", profile.Source, &existing.Source)
+		mergeTargets("host", profile.Host, &existing.Host)
+		mergeTargets("target", profile.Target, &existing.Target)
+		cfg.Profile[name] = existing
+	}
+	return errs
+}
+
+// resolveTemplates replaces the extends of every template, host and target with what it inherits. A list
+// that is set overrides the inherited one, the lists in append are added to it and vars and env are
+// overridden per key.
+func (cfg *Config) resolveTemplates() ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	report := func(origin *configOrigin, key []string, format string, a ...any) {
+		errs = append(errs, &ConfigError{file: origin.path, line: origin.lines.line(key), key: strings.Join(key, "."), message: fmt.Sprintf(format, a...)})
+	}
+
+	inheritList := func(list []string, inherited []string, appended []string) []string {
+		if list == nil {
+			list = inherited
+		}
+		if len(appended) == 0 {
+			return list
+		}
+		return append(slices.Clone(list), appended...)
+	}
+	inheritVars := func(vars map[string]string, inherited map[string]string) map[string]string {
+		if len(inherited) == 0 {
+			return vars
+		}
+		merged := make(map[string]string)
+		for key, value := range inherited {
+			merged[key] = value
+		}
+		for key, value := range vars {
+			merged[key] = value
+		}
+		return merged
+	}
+	inherit := func(target ConfigStandardTarget, template ConfigHostTarget) ConfigStandardTarget {
+		target.Dependencies = inheritList(target.Dependencies, template.Dependencies, target.Append.Dependencies)
+		target.Configure = inheritList(target.Configure, template.Configure, target.Append.Configure)
+		target.Build = inheritList(target.Build, template.Build, target.Append.Build)
+		target.Install = inheritList(target.Install, template.Install, target.Append.Install)
+		target.Vars = inheritVars(target.Vars, template.Vars)
+		target.Env = inheritVars(target.Env, template.Env)
+		target.Extends = ""
+		target.Append = ConfigAppend{}
+		return target
+	}
+
+	resolved := make(map[string]*ConfigHostTarget)
+	// templates that are currently being resolved, any of them being extended again means there is a cycle
+	resolving := make([]string, 0)
+	var resolve func(name string) *ConfigHostTarget
+	resolve = func(name string) *ConfigHostTarget {
+		if template, ok := resolved[name]; ok {
+			return template
+		}
+		if i := slices.Index(resolving, name); i >= 0 {
+			template := cfg.Template[name]
+			report(template.origin, []string{"template", name, "extends"}, "template cycle (%s -> %s)", strings.Join(resolving[i:], " -> "), name)
+			return nil
+		}
+
+		template := cfg.Template[name]
+		if template.Extends != "" {
+			if _, ok := cfg.Template[template.Extends]; !ok {
+				report(template.origin, []string{"template", name, "extends"}, "undefined template %s", template.Extends)
+				resolved[name] = nil
+				return nil
+			}
+			resolving = append(resolving, name)
+			parent := resolve(template.Extends)
+			resolving = resolving[:len(resolving)-1]
+			if parent == nil {
+				// the problem has been reported where it was found
+				resolved[name] = nil
+				return nil
+			}
+
+			runtimeDependencies := inheritList(template.RuntimeDependencies, parent.RuntimeDependencies, template.Append.RuntimeDependencies)
+			template.ConfigStandardTarget = inherit(template.ConfigStandardTarget, *parent)
+			template.RuntimeDependencies = runtimeDependencies
+		}
+		resolved[name] = &template
+		return &template
+	}
+
+	extend := func(kind string, id string, target ConfigStandardTarget) (*ConfigHostTarget, bool) {
+		if target.Extends == "" {
+			return nil, false
+		}
+		key := []string{kind, id, "extends"}
+		if _, ok := cfg.Template[target.Extends]; !ok {
+			report(target.origin, key, "undefined template %s", target.Extends)
+			return nil, false
+		}
+		template := resolve(target.Extends)
+		return template, template != nil
+	}
+	missingInstall := func(kind string, id string, target ConfigStandardTarget) {
+		if target.Install == nil {
+			report(target.origin, []string{kind, id, "install"}, "missing required key, it is neither set nor inherited")
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.Template) {
+		resolve(name)
+	}
+	for _, id := range sortedKeys(cfg.Host) {
+		host := cfg.Host[id]
+		template, ok := extend("host", id, host.ConfigStandardTarget)
+		if !ok {
+			continue
+		}
+		host.RuntimeDependencies = inheritList(host.RuntimeDependencies, template.RuntimeDependencies, host.Append.RuntimeDependencies)
+		host.ConfigStandardTarget = inherit(host.ConfigStandardTarget, *template)
+		missingInstall("host", id, host.ConfigStandardTarget)
+		cfg.Host[id] = host
+	}
+	for _, id := range sortedKeys(cfg.Target) {
+		target := cfg.Target[id]
+		template, ok := extend("target", id, target)
+		if !ok {
+			continue
+		}
+		if len(template.RuntimeDependencies) > 0 {
+			report(target.origin, []string{"target", id, "extends"}, "template %s has runtime-dependencies, they only apply to host targets", target.Extends)
+		}
+		target = inherit(target, *template)
+		missingInstall("target", id, target)
+		cfg.Target[id] = target
+	}
+
+	errs.sort()
+	return errs
+}
+
+// ApplyProfile applies the overrides of the named profile to the config
+func (cfg *Config) ApplyProfile(name string) error {
+	profile, ok := cfg.Profile[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %s", name)
 	}
 
-	var cfg Config
-	if _, err = toml.Decode(string(data), &cfg); err != nil {
-		panic(err)
+	overrideVars := func(vars map[string]string, overrides map[string]string) map[string]string {
+		if len(overrides) == 0 {
+			return vars
+		}
+		merged := make(map[string]string)
+		for key, value := range vars {
+			merged[key] = value
+		}
+		for key, value := range overrides {
+			merged[key] = value
+		}
+		return merged
+	}
+	overrideList := func(list []string, override *[]string) []string {
+		if override == nil {
+			return list
+		}
+		return *override
+	}
+	overrideTarget := func(target *ConfigTarget, override ConfigProfileTarget) {
+		target.Dependencies = overrideList(target.Dependencies, override.Dependencies)
+		target.Vars = overrideVars(target.Vars, override.Vars)
+		target.Env = overrideVars(target.Env, override.Env)
+	}
+	overrideStandardTarget := func(target *ConfigStandardTarget, override ConfigProfileTarget) {
+		overrideTarget(&target.ConfigTarget, override)
+		target.Configure = overrideList(target.Configure, override.Configure)
+		target.Build = overrideList(target.Build, override.Build)
+		target.Install = overrideList(target.Install, override.Install)
+	}
+
+	cfg.Project.Vars = overrideVars(cfg.Project.Vars, profile.Vars)
+	for id, override := range profile.Source {
+		source := cfg.Source[id]
+		overrideTarget(&source.ConfigTarget, override)
+		cfg.Source[id] = source
+	}
+	for id, override := range profile.Host {
+		host := cfg.Host[id]
+		overrideStandardTarget(&host.ConfigStandardTarget, override)
+		host.RuntimeDependencies = overrideList(host.RuntimeDependencies, override.RuntimeDependencies)
+		cfg.Host[id] = host
+	}
+	for id, override := range profile.Target {
+		target := cfg.Target[id]
+		overrideStandardTarget(&target, override)
+		cfg.Target[id] = target
 	}
 
-	return &cfg
+	// the overridden dependencies can form cycles the config itself does not have
+	if errs := cfg.validateCycles(); len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
+	ctx.vars = cfg.Project.Vars
+
 	var ensureTarget func(tag Tag) (*Target, error)
 	var ensureTargets func(tags []Tag) ([]*Target, error)
 	var findTarget func(tag Tag) *Target
 
 	targets := make([]*Target, 0)
+	// tags that are currently being resolved, any of them being required again means there is a cycle
+	resolving := make([]Tag, 0)
 	findTarget = func(tag Tag) *Target {
 		for _, target := range targets {
 			if target.tag != tag {
@@ -92,11 +541,27 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 	}
 
 	ensureTarget = func(tag Tag) (*Target, error) {
+		if i := slices.Index(resolving, tag); i >= 0 {
+			cycle := make([]string, 0)
+			for _, cycleTag := range resolving[i:] {
+				cycle = append(cycle, cycleTag.ToString())
+			}
+			cycle = append(cycle, tag.ToString())
+			return nil, fmt.Errorf("dependency cycle (%s)", strings.Join(cycle, " -> "))
+		}
+
 		target := findTarget(tag)
 		if target != nil {
 			return target, nil
 		}
 
+		resolving = append(resolving, tag)
+		defer func() {
+			resolving = resolving[:len(resolving)-1]
+		}()
+
+		var targetConfig any
+
 		target = &Target{
 			tag:                 tag,
 			runtimeDependencies: make([]*Target, 0),
@@ -110,12 +575,52 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 			if cfgSource == nil {
 				return nil, fmt.Errorf("undefined target (%s)", tag.ToString())
 			}
+			targetConfig = cfgSource
 
 			source := SourceTarget{
 				Target:     target,
 				sourceType: cfgSource.Type,
-				url:        cfgSource.Url,
-				modifiers:  make([]SourceModifier, 0),
+				url:        strings.ReplaceAll(cfgSource.Url, "$VERSION", cfgSource.Version),
+				git: GitOptions{
+					commit:     cfgSource.Commit,
+					tag:        cfgSource.Tag,
+					branch:     cfgSource.Branch,
+					depth:      cfgSource.Depth,
+					submodules: cfgSource.Submodules,
+				},
+				modifiers: make([]SourceModifier, 0),
+				ignore:    cfgSource.Ignore,
+				license:   cfgSource.License,
+				homepage:  cfgSource.Homepage,
+			}
+
+			if cfgSource.Type == "local" {
+				// local sources are relative to the file that declares them, the url stays as written so that
+				// it means the same wherever the project is checked out
+				source.path = cfgSource.origin.resolve(source.url)
+
+				// the contents of a local source can change between runs, so they are part of its fingerprint
+				treeHash, err := TreeHash(source.path, cfgSource.Ignore)
+				if err != nil && !os.IsNotExist(err) {
+					return nil, fmt.Errorf("failed to scan local source %s: %w", tag.ToString(), err)
+				}
+				source.treeHash = treeHash
+			}
+
+			source.stripComponents = 1
+			if cfgSource.StripComponents != nil {
+				source.stripComponents = *cfgSource.StripComponents
+			}
+
+			for _, checksum := range []Checksum{
+				{algorithm: "sha256", value: cfgSource.Sha256},
+				{algorithm: "sha512", value: cfgSource.Sha512},
+				{algorithm: "blake2b", value: cfgSource.Blake2b},
+			} {
+				if checksum.value == "" {
+					continue
+				}
+				source.checksums = append(source.checksums, checksum)
 			}
 
 			deps, err := StringsToTags(cfgSource.Dependencies)
@@ -127,7 +632,9 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 				return nil, err
 			}
 
+			patches := make([]string, 0)
 			for _, modifier := range cfgSource.Modifiers {
+				var hashes []string
 				var modTarget *Target = nil
 				if modifier.Source != "" {
 					modTag, err := CreateTag(modifier.Source, "source")
@@ -139,24 +646,59 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 						return nil, err
 					}
 				}
+				strip := 1
+				if modifier.Strip != nil {
+					strip = *modifier.Strip
+				}
+				path := ""
+				if modTarget == nil && (modifier.Type == "patch" || modifier.Type == "patches") {
+					// patches that do not come from a source are files next to the config, unlike patches
+					// from a source they are not part of any other fingerprint so they are hashed here
+					path = cfgSource.origin.resolve(modifier.File)
+					var err error
+					hashes, err = patchHashes(path, modifier.Type == "patches")
+					if err != nil {
+						return nil, fmt.Errorf("failed to read patches of %s: %w", tag.ToString(), err)
+					}
+					patches = append(patches, hashes...)
+				}
 				source.modifiers = append(source.modifiers, SourceModifier{
 					modifierType: modifier.Type,
 					source:       modTarget,
 					file:         modifier.File,
 					cmd:          modifier.Cmd,
+					strip:        strip,
+					allowFuzz:    modifier.AllowFuzz,
+					path:         path,
+					hashes:       hashes,
 				})
 				if modTarget != nil {
 					source.dependencies = append(source.dependencies, modTarget)
 				}
 			}
 
+			if source.treeHash != "" || len(patches) > 0 {
+				targetConfig = struct {
+					*ConfigSourceTarget
+					Tree    string   `json:",omitempty"`
+					Patches []string `json:",omitempty"`
+				}{cfgSource, source.treeHash, patches}
+			}
+
+			target.version = cfgSource.Version
+			target.vars, target.env = cfgSource.Vars, cfgSource.Env
+			target.source = &source
 			target.do = ctx.makeSourceDoer(&source)
+			target.fetch = ctx.makeSourceFetcher(&source)
 		case "host":
 			cfgHost := cfg.FindHost(tag.id)
 			if cfgHost == nil {
 				return nil, fmt.Errorf("undefined target (%s)", tag.ToString())
 			}
+			targetConfig = cfgHost
 
+			target.version = cfgHost.Version
+			target.vars, target.env = cfgHost.Vars, cfgHost.Env
 			host := &HostTarget{
 				Target:    target,
 				configure: cfgHost.Configure,
@@ -191,7 +733,10 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 			if cfgStandard == nil {
 				return nil, fmt.Errorf("undefined target (%s)", tag.ToString())
 			}
+			targetConfig = cfgStandard
 
+			target.version = cfgStandard.Version
+			target.vars, target.env = cfgStandard.Vars, cfgStandard.Env
 			std := &StandardTarget{
 				Target:    target,
 				configure: cfgStandard.Configure,
@@ -211,6 +756,12 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 			target.do = ctx.makeCommonTarget((*CommonTarget)(std), false)
 		}
 
+		fingerprint, err := Fingerprint(tag, targetConfig, cfg.Project.Vars, target.allDependencies())
+		if err != nil {
+			return nil, err
+		}
+		target.fingerprint = fingerprint
+
 		return target, nil
 	}
 
@@ -245,6 +796,12 @@ func (cfg *Config) BuildTargets(ctx *Context) ([]*Target, error) {
 		}
 	}
 
+	for _, target := range targets {
+		for _, dep := range target.allDependencies() {
+			dep.dependents = append(dep.dependents, target)
+		}
+	}
+
 	return targets, nil
 }
 
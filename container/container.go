@@ -1,6 +1,7 @@
 package chariot_container
 
 import (
+	"context"
 	"io"
 	"os"
 	"os/exec"
@@ -15,6 +16,7 @@ type ExecContext struct {
 	containerPath string
 	cwd           string
 	mounts        []Mount
+	env           []string
 	stdOut        io.Writer
 	stdErr        io.Writer
 }
@@ -31,7 +33,9 @@ func HostInit() {
 	}
 }
 
-func Exec(containerPath string, cmd string, cwd string, mounts []Mount, stdOut io.Writer, stdErr io.Writer, stdIn io.Reader) error {
+// Exec runs cmd inside of the container with env (KEY=value) added to its environment. Cancelling ctx
+// kills the command along with every process it started, as the command runs in its own pid namespace.
+func Exec(ctx context.Context, containerPath string, cmd string, cwd string, mounts []Mount, env []string, stdOut io.Writer, stdErr io.Writer, stdIn io.Reader) error {
 	var strs []string = make([]string, 0)
 	for _, mount := range mounts {
 		strs = append(strs, mount.To+":"+mount.From)
@@ -52,8 +56,10 @@ func Exec(containerPath string, cmd string, cwd string, mounts []Mount, stdOut i
 		"LC_COLLATE=C",
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/bin:/usr/bin/core_perl",
 	}
+	proc.Env = append(proc.Env, env...)
 	proc.SysProcAttr = &syscall.SysProcAttr{
 		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUSER,
+		Pdeathsig:  syscall.SIGKILL,
 		UidMappings: []syscall.SysProcIDMap{
 			{ContainerID: 0, HostID: os.Geteuid(), Size: 1},
 		},
@@ -62,21 +68,43 @@ func Exec(containerPath string, cmd string, cwd string, mounts []Mount, stdOut i
 		},
 	}
 
-	return proc.Run()
+	if err := proc.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the process is the init of its pid namespace, the kernel kills the rest of the namespace with it
+			proc.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	if err := proc.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
 }
 
-func Use(containerPath string, cwd string, mounts []Mount, stdOut io.Writer, stdErr io.Writer) *ExecContext {
+func Use(containerPath string, cwd string, mounts []Mount, env []string, stdOut io.Writer, stdErr io.Writer) *ExecContext {
 	var context ExecContext
 	context.containerPath = containerPath
 	context.cwd = cwd
 	context.mounts = mounts
+	context.env = env
 	context.stdOut = stdOut
 	context.stdErr = stdErr
 	return &context
 }
 
-func (context *ExecContext) Exec(cmd string) error {
-	return Exec(context.containerPath, cmd, context.cwd, context.mounts, context.stdOut, context.stdErr, nil)
+func (context *ExecContext) Exec(ctx context.Context, cmd string) error {
+	return Exec(ctx, context.containerPath, cmd, context.cwd, context.mounts, context.env, context.stdOut, context.stdErr, nil)
 }
 
 func containerEntry() {
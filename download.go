@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DOWNLOAD_PROGRESS_INTERVAL = 100 * time.Millisecond
+	DOWNLOAD_LOCK_INTERVAL     = 200 * time.Millisecond
+	DOWNLOAD_DIAL_TIMEOUT      = 30 * time.Second
+	DOWNLOAD_HEADER_TIMEOUT    = 30 * time.Second
+	DOWNLOAD_IDLE_TIMEOUT      = 60 * time.Second
+)
+
+// Downloader fetches files over http(s), retrying failed attempts with an exponential backoff and
+// resuming from whatever a previous attempt (or run) managed to download
+type Downloader struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	offline bool
+	// a download that receives nothing for this long is given up on and retried
+	idleTimeout time.Duration
+}
+
+// DownloadError is an error that retrying will not fix, such as a 404
+type DownloadError struct {
+	name   string
+	url    string
+	status string
+}
+
+// idleReader calls reset with every read, so that a timer can tell when the body stalls
+type idleReader struct {
+	in    io.Reader
+	reset func()
+}
+
+type progressWriter struct {
+	out      io.Writer
+	done     int64
+	total    int64
+	last     time.Time
+	progress func(done int64, total int64)
+}
+
+func CreateDownloader(retries int, offline bool) *Downloader {
+	// the default client never times out, a stalled connection would hang the download forever
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: DOWNLOAD_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   DOWNLOAD_DIAL_TIMEOUT,
+		ResponseHeaderTimeout: DOWNLOAD_HEADER_TIMEOUT,
+	}
+	return &Downloader{
+		client:      &http.Client{Transport: transport},
+		retries:     retries,
+		backoff:     time.Second,
+		offline:     offline,
+		idleTimeout: DOWNLOAD_IDLE_TIMEOUT,
+	}
+}
+
+// lock makes sure only one job at a time downloads to the path, returning the matching unlock. The
+// distfiles can be shared between projects, so this locks a file next to the path which holds across
+// processes as well.
+func (downloader *Downloader) lock(runCtx context.Context, path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), DEFAULT_FILE_PERM); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		// polling keeps waiting for another process interruptible
+		select {
+		case <-runCtx.Done():
+			file.Close()
+			return nil, runCtx.Err()
+		case <-time.After(DOWNLOAD_LOCK_INTERVAL):
+		}
+	}
+	// closing the file releases the lock, the file itself stays as removing it would race with others
+	return func() { file.Close() }, nil
+}
+
+func (err *DownloadError) Error() string {
+	return fmt.Sprintf("failed to download %s (%s): %s", err.name, err.url, err.status)
+}
+
+func (reader *idleReader) Read(buf []byte) (int, error) {
+	n, err := reader.in.Read(buf)
+	reader.reset()
+	return n, err
+}
+
+func (writer *progressWriter) Write(buf []byte) (int, error) {
+	n, err := writer.out.Write(buf)
+	writer.done += int64(n)
+	if writer.progress != nil && time.Since(writer.last) >= DOWNLOAD_PROGRESS_INTERVAL {
+		writer.last = time.Now()
+		writer.progress(writer.done, writer.total)
+	}
+	return n, err
+}
+
+// Download fetches url into path. The name identifies what is being downloaded in errors and progress
+// is called with the number of bytes downloaded so far and the total size (-1 when unknown).
+func (downloader *Downloader) Download(runCtx context.Context, name string, url string, path string, progress func(done int64, total int64)) error {
+	if downloader.offline {
+		return fmt.Errorf("%s (%s) is not available offline, expected it at %s", name, url, path)
+	}
+
+	var err error
+	for attempt := 0; attempt <= downloader.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-runCtx.Done():
+				return runCtx.Err()
+			case <-time.After(downloader.backoff * time.Duration(1<<(attempt-1))):
+			}
+		}
+
+		err = downloader.attempt(runCtx, name, url, path, progress)
+		if err == nil {
+			return nil
+		}
+		var downloadErr *DownloadError
+		if runCtx.Err() != nil || errors.As(err, &downloadErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to download %s (%s) after %d attempt(s): %w", name, url, downloader.retries+1, err)
+}
+
+func (downloader *Downloader) attempt(runCtx context.Context, name string, url string, path string, progress func(done int64, total int64)) error {
+	partPath := path + ".part"
+
+	var offset int64 = 0
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	attemptCtx, cancel := context.WithCancel(runCtx)
+	defer cancel()
+	idle := time.AfterFunc(downloader.idleTimeout, cancel)
+	defer idle.Stop()
+
+	request, err := http.NewRequestWithContext(attemptCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return &DownloadError{name: name, url: url, status: err.Error()}
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	response, err := downloader.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case response.StatusCode == http.StatusPartialContent:
+		// the server has to resume exactly where the partial file ends, anything else is corrupt
+		if !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(partPath)
+			return fmt.Errorf("server resumed %s at the wrong offset", name)
+		}
+		flags |= os.O_APPEND
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is no longer valid (e.g. the file changed upstream), start over
+		os.Remove(partPath)
+		return fmt.Errorf("server rejected resuming %s", name)
+	case response.StatusCode == http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	case response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("server responded with %s", response.Status)
+	default:
+		return &DownloadError{name: name, url: url, status: response.Status}
+	}
+
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	} else if contentRange := response.Header.Get("Content-Range"); contentRange != "" {
+		if size, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64); err == nil {
+			total = size
+		}
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	writer := &progressWriter{out: file, done: offset, total: total, progress: progress}
+	reader := &idleReader{in: response.Body, reset: func() { idle.Reset(downloader.idleTimeout) }}
+	if _, err := io.Copy(writer, reader); err != nil {
+		file.Close()
+		if attemptCtx.Err() != nil && runCtx.Err() == nil {
+			return fmt.Errorf("download of %s stalled for %s after %d bytes", name, downloader.idleTimeout, writer.done)
+		}
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if total >= 0 && writer.done != total {
+		return fmt.Errorf("download of %s ended after %d of %d bytes", name, writer.done, total)
+	}
+	if progress != nil {
+		progress(writer.done, total)
+	}
+
+	return os.Rename(partPath, path)
+}
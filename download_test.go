@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestDownloader returns a downloader that does not keep tests waiting between attempts
+func createTestDownloader(retries int) *Downloader {
+	downloader := CreateDownloader(retries, false)
+	downloader.backoff = time.Millisecond
+	return downloader
+}
+
+func TestDownloadRetriesServerErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := createTestDownloader(3).Download(context.Background(), "source:test", server.URL, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "archive" {
+		t.Errorf("expected the downloaded archive, got %q (%v)", data, err)
+	}
+}
+
+func TestDownloadResumesPartialFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=6-" {
+			t.Errorf("expected to resume at byte 6, got range %q", r.Header.Get("Range"))
+			w.Write([]byte("hello world"))
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 6-10/11")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("world"))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path+".part", []byte("hello "), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTestDownloader(0).Download(context.Background(), "source:test", server.URL, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "hello world" {
+		t.Errorf("expected the resumed archive, got %q (%v)", data, err)
+	}
+	if FileExists(path + ".part") {
+		t.Error("expected the partial file to be renamed")
+	}
+}
+
+func TestDownloadDoesNotRetryNotFound(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "archive")
+	err := createTestDownloader(3).Download(context.Background(), "source:missing", server.URL, path, nil)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf("expected a download error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "source:missing") {
+		t.Errorf("expected the error to name the source, got %q", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestDownloadRetriesStalledTransfer(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Length", "11")
+			w.Write([]byte("hello "))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 6-10/11")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("world"))
+	}))
+	defer server.Close()
+
+	downloader := createTestDownloader(1)
+	downloader.idleTimeout = 100 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := downloader.Download(context.Background(), "source:test", server.URL, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "hello world" {
+		t.Errorf("expected the resumed archive, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var ARCHIVE_TYPES = []string{"tar", "tar.gz", "tar.xz", "tar.bz2", "tar.zst", "tar.lz", "zip", "file"}
+
+type extractedDir struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// ExtractArchive unpacks the archive at path into dest, dropping the first `strip` components of every
+// path like `tar --strip-components` does. The "file" type copies the file as is to dest/name.
+func ExtractArchive(path string, archiveType string, dest string, strip int, name string) error {
+	if archiveType == "file" {
+		return Copy(path, filepath.Join(dest, name))
+	}
+	if archiveType == "zip" {
+		return extractZip(path, dest, strip)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader
+	switch archiveType {
+	case "tar":
+		reader = file
+	case "tar.gz":
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "tar.xz":
+		reader, err = xz.NewReader(file)
+		if err != nil {
+			return err
+		}
+	case "tar.bz2":
+		reader = bzip2.NewReader(file)
+	case "tar.zst":
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	case "tar.lz":
+		reader, err = newLzipReader(file)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported archive type (%s)", archiveType)
+	}
+	return extractTar(reader, dest, strip)
+}
+
+func extractTar(reader io.Reader, dest string, strip int) error {
+	dirs := make([]extractedDir, 0)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := stripPath(dest, header.Name, strip)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, DEFAULT_FILE_PERM); err != nil {
+				return err
+			}
+			dirs = append(dirs, extractedDir{path: path, mode: header.FileInfo().Mode(), modTime: header.ModTime})
+		case tar.TypeReg:
+			if err := writeFile(dest, path, tarReader, header.FileInfo().Mode(), header.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := prepareEntry(dest, path); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := stripPath(dest, header.Linkname, strip)
+			if err != nil {
+				return err
+			}
+			if target == "" {
+				return fmt.Errorf("hard link %s points outside of the extracted tree", header.Name)
+			}
+			if err := prepareEntry(dest, path); err != nil {
+				return err
+			}
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			// device files and the like cannot be created without privileges and have no place in a source tree
+			continue
+		}
+	}
+	return finishDirs(dirs)
+}
+
+func extractZip(path string, dest string, strip int) error {
+	zipReader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	dirs := make([]extractedDir, 0)
+	for _, file := range zipReader.File {
+		path, err := stripPath(dest, file.Name, strip)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(path, DEFAULT_FILE_PERM); err != nil {
+				return err
+			}
+			dirs = append(dirs, extractedDir{path: path, mode: mode, modTime: file.Modified})
+		case mode&os.ModeSymlink != 0:
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+			link, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			if err := prepareEntry(dest, path); err != nil {
+				return err
+			}
+			if err := os.Symlink(string(link), path); err != nil {
+				return err
+			}
+		default:
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = writeFile(dest, path, reader, mode, file.Modified)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return finishDirs(dirs)
+}
+
+// stripPath resolves an archive entry to its destination, an empty path means the entry is stripped
+func stripPath(dest string, name string, strip int) (string, error) {
+	parts := strings.Split(strings.Trim(filepath.ToSlash(name), "/"), "/")
+	if len(parts) <= strip {
+		return "", nil
+	}
+	rel := filepath.Join(parts[strip:]...)
+	if rel == "." {
+		return "", nil
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("archive entry %s escapes the destination", name)
+	}
+	return filepath.Join(dest, rel), nil
+}
+
+// prepareEntry makes sure the parent of path exists, is not reached through a symlink that leaves
+// dest and that nothing is in the way of creating path
+func prepareEntry(dest string, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), DEFAULT_FILE_PERM); err != nil {
+		return err
+	}
+
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(realDest, realParent); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("archive entry %s escapes the destination", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writeFile(dest string, path string, reader io.Reader, mode os.FileMode, modTime time.Time) error {
+	if err := prepareEntry(dest, path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// the umask would otherwise strip bits, making the tree differ from one machine to the next
+	if err := os.Chmod(path, mode.Perm()); err != nil {
+		return err
+	}
+	// build systems such as autotools compare timestamps, so they have to survive extraction
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// finishDirs applies directory permissions and timestamps once nothing is written into them anymore
+func finishDirs(dirs []extractedDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lzipReader decodes every member of an lzip stream one after the other, tools like plzip and lzip -b
+// split their output into several members
+type lzipReader struct {
+	reader  *bufio.Reader
+	member  io.Reader
+	crc     hash.Hash32
+	size    uint64
+	members int
+}
+
+// lzipMemberReader feeds a rewritten .lzma header to the decoder before the member itself. It reads the
+// member byte by byte so the decoder does not consume the trailer that follows it.
+type lzipMemberReader struct {
+	header []byte
+	reader *bufio.Reader
+}
+
+// newLzipReader decodes an lzip stream. Lzip wraps LZMA streams with fixed properties (lc=3, lp=0,
+// pb=2) behind a 6 byte header and a 20 byte trailer, so the header of each member is rewritten into a
+// .lzma header and the trailer is checked once the member is decoded.
+func newLzipReader(reader io.Reader) (io.Reader, error) {
+	lzipReader := &lzipReader{reader: bufio.NewReader(reader), crc: crc32.NewIEEE()}
+	if err := lzipReader.next(); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty lzip stream")
+		}
+		return nil, err
+	}
+	return lzipReader, nil
+}
+
+// next starts decoding the next member, it returns io.EOF if the stream has no more members
+func (r *lzipReader) next() error {
+	header := make([]byte, 6)
+	if n, err := io.ReadFull(r.reader, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return fmt.Errorf("truncated lzip member header")
+	}
+	if string(header[:4]) != "LZIP" || header[4] != 1 {
+		return fmt.Errorf("lzip member %d is not an lzip (version 1) member", r.members+1)
+	}
+
+	dictSize := uint32(1) << (header[5] & 0x1f)
+	dictSize -= (dictSize / 16) * uint32(header[5]>>5)
+
+	lzmaHeader := make([]byte, 13)
+	lzmaHeader[0] = 0x5d
+	binary.LittleEndian.PutUint32(lzmaHeader[1:], dictSize)
+	binary.LittleEndian.PutUint64(lzmaHeader[5:], math.MaxUint64)
+	member, err := lzma.NewReader(&lzipMemberReader{header: lzmaHeader, reader: r.reader})
+	if err != nil {
+		return err
+	}
+	r.member = member
+	r.crc.Reset()
+	r.size = 0
+	r.members++
+	return nil
+}
+
+// finish checks the trailer of the member that was just decoded
+func (r *lzipReader) finish() error {
+	trailer := make([]byte, 20)
+	if _, err := io.ReadFull(r.reader, trailer); err != nil {
+		return fmt.Errorf("truncated trailer of lzip member %d", r.members)
+	}
+	if binary.LittleEndian.Uint32(trailer[0:]) != r.crc.Sum32() {
+		return fmt.Errorf("lzip member %d has a bad checksum", r.members)
+	}
+	if binary.LittleEndian.Uint64(trailer[4:]) != r.size {
+		return fmt.Errorf("lzip member %d has a bad size", r.members)
+	}
+	return nil
+}
+
+func (r *lzipReader) Read(p []byte) (int, error) {
+	for {
+		if r.member == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.member.Read(p)
+		r.crc.Write(p[:n])
+		r.size += uint64(n)
+		if err == io.EOF {
+			r.member = nil
+			if err := r.finish(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *lzipMemberReader) Read(p []byte) (int, error) {
+	if len(r.header) > 0 {
+		n := copy(p, r.header)
+		r.header = r.header[n:]
+		return n, nil
+	}
+	return r.reader.Read(p)
+}
+
+func (r *lzipMemberReader) ReadByte() (byte, error) {
+	if len(r.header) > 0 {
+		c := r.header[0]
+		r.header = r.header[1:]
+		return c, nil
+	}
+	return r.reader.ReadByte()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// fetchSources downloads the archives and snapshots the git repositories of every source the targets
+// depend on, so that they can be built with --offline afterwards
+func (ctx *Context) fetchSources(runCtx context.Context, targets []*Target) error {
+	failed := 0
+	for _, target := range dependencyOrder(targets) {
+		if target.fetch == nil {
+			continue
+		}
+		if err := target.fetch(runCtx); err != nil {
+			if runCtx.Err() != nil {
+				return fmt.Errorf("fetch interrupted")
+			}
+			ctx.cli.Printf("%s: %s\n", target.tag.ToString(), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d source(s) failed to fetch", failed)
+	}
+	return nil
+}
+
+func (ctx *Context) makeSourceFetcher(source *SourceTarget) func(runCtx context.Context) error {
+	return func(runCtx context.Context) error {
+		task := ctx.cli.StartTask("Fetching %s", source.tag.ToString())
+		defer task.Stop()
+
+		switch {
+		case slices.Contains(ARCHIVE_TYPES, source.sourceType):
+			_, err := ctx.fetchArchive(runCtx, task, source)
+			return err
+		case source.sourceType == "git":
+			return ctx.snapshotGit(runCtx, source)
+		}
+		return nil
+	}
+}
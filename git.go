@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// fetchGit clones the repository of a git source at the configured commit, tag or branch. Unless a
+// commit is pinned, the commit that was recorded the last time the same ref was fetched is reused, so
+// that re-preparing a source (e.g. after a modifier changed) does not silently move it to a newer
+// upstream revision. Explicitly requesting the source fetches the latest revision of the ref instead.
+func (ctx *Context) fetchGit(runCtx context.Context, source *SourceTarget, sourcePath string) error {
+	ref, revisionRef := source.gitRef()
+	if ctx.downloader.offline {
+		return ctx.extractGitSnapshot(runCtx, source, sourcePath)
+	}
+
+	fetch := ref
+	if source.git.commit == "" && !source.redo {
+		if meta, err := ctx.cache.ReadMeta(source.tag); err == nil && meta.Revision != nil && meta.Revision.Ref == revisionRef {
+			fetch = meta.Revision.Commit
+		}
+	}
+
+	git := ctx.gitRunner(runCtx, source.Target, sourcePath)
+
+	depth := make([]string, 0)
+	if source.git.depth > 0 {
+		depth = append(depth, "--depth", fmt.Sprint(source.git.depth))
+	}
+
+	if _, err := git("init", "-q"); err != nil {
+		return err
+	}
+	if _, err := git("remote", "add", "origin", source.url); err != nil {
+		return err
+	}
+	// fetching by hash is allowed to fail quietly, the fallback reports whatever actually went wrong
+	byHash := fetch != ref || source.git.commit != ""
+	fetcher := git
+	if byHash {
+		fetcher = gitRunnerTo(runCtx, sourcePath, io.Discard)
+	}
+
+	checkout := "FETCH_HEAD"
+	if _, err := fetcher(append(append([]string{"fetch", "-q"}, depth...), "origin", fetch)...); err != nil {
+		if !byHash {
+			return err
+		}
+		// only some servers allow fetching a commit by its hash, otherwise it is taken from the history of
+		// the ref it was recorded for or, for pinned commits, from everything the server has
+		fallback := []string{"fetch", "-q", "--tags", "origin"}
+		if source.git.commit == "" {
+			fallback = append(fallback, ref)
+		}
+		if _, err := git(fallback...); err != nil {
+			return err
+		}
+		checkout = fetch
+	}
+	if _, err := git("checkout", "-q", checkout); err != nil {
+		return err
+	}
+	if source.git.submodules {
+		if _, err := git(append([]string{"submodule", "update", "-q", "--init", "--recursive"}, depth...)...); err != nil {
+			return err
+		}
+	}
+
+	commit, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	source.revision = &Revision{Ref: revisionRef, Commit: commit}
+	return nil
+}
+
+// gitRef returns the ref to fetch for a git source and the ref a fetched revision is recorded under
+func (source *SourceTarget) gitRef() (string, string) {
+	ref := "HEAD"
+	switch {
+	case source.git.commit != "":
+		ref = source.git.commit
+	case source.git.tag != "":
+		ref = fmt.Sprintf("refs/tags/%s", source.git.tag)
+	case source.git.branch != "":
+		ref = fmt.Sprintf("refs/heads/%s", source.git.branch)
+	}
+	return ref, fmt.Sprintf("%s#%s", source.url, ref)
+}
+
+func (ctx *Context) gitRunner(runCtx context.Context, target *Target, dir string) func(args ...string) (string, error) {
+	_, errWriter := ctx.writers(target)
+	return gitRunnerTo(runCtx, dir, errWriter)
+}
+
+// gitRunnerTo returns a runner for git commands in dir that writes their stderr to errWriter
+func gitRunnerTo(runCtx context.Context, dir string, errWriter io.Writer) func(args ...string) (string, error) {
+	return func(args ...string) (string, error) {
+		var out bytes.Buffer
+		cmd := exec.CommandContext(runCtx, "git", args...)
+		cmd.Dir = dir
+		cmd.Stdout = &out
+		cmd.Stderr = errWriter
+		if err := cmd.Run(); err != nil {
+			return "", &PhaseError{phase: "fetch", cmd: cmd.String(), err: err}
+		}
+		return strings.TrimSpace(out.String()), nil
+	}
+}
+
+// snapshotGit stores a checkout of a git source (including submodules and the .git directory) in the
+// distfiles, so that the source can be prepared without network access
+func (ctx *Context) snapshotGit(runCtx context.Context, source *SourceTarget) error {
+	_, revisionRef := source.gitRef()
+	snapshotPath := ctx.cache.GitSnapshotPath(revisionRef)
+	unlock, err := ctx.downloader.lock(runCtx, snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// commits and tags do not move, so an existing snapshot of them is still good
+	if FileExists(snapshotPath) && (source.git.commit != "" || source.git.tag != "") {
+		return nil
+	}
+
+	checkoutPath := snapshotPath + ".checkout"
+
+	if err := os.RemoveAll(checkoutPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(checkoutPath, DEFAULT_FILE_PERM); err != nil {
+		return err
+	}
+	defer os.RemoveAll(checkoutPath)
+
+	if err := ctx.fetchGit(runCtx, source, checkoutPath); err != nil {
+		return err
+	}
+	return WriteTarball(checkoutPath, snapshotPath)
+}
+
+func (ctx *Context) extractGitSnapshot(runCtx context.Context, source *SourceTarget, sourcePath string) error {
+	_, revisionRef := source.gitRef()
+	snapshotPath := ctx.cache.GitSnapshotPath(revisionRef)
+	if !FileExists(snapshotPath) {
+		return fmt.Errorf("%s (%s) is not available offline, expected a snapshot at %s", source.tag.ToString(), revisionRef, snapshotPath)
+	}
+	if err := ExtractArchive(snapshotPath, "tar.gz", sourcePath, 0, ""); err != nil {
+		return &PhaseError{phase: "extract", cmd: snapshotPath, err: err}
+	}
+
+	commit, err := ctx.gitRunner(runCtx, source.Target, sourcePath)("rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	source.revision = &Revision{Ref: revisionRef, Commit: commit}
+	return nil
+}
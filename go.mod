@@ -4,8 +4,11 @@ go 1.21.3
 
 require (
 	github.com/BurntSushi/toml v1.3.2
-	github.com/docker/docker v24.0.7+incompatible
 	github.com/briandowns/spinner v1.23.0
+	github.com/docker/docker v24.0.7+incompatible
+	github.com/klauspost/compress v1.17.4
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.14.0
 )
 
 require (
@@ -13,6 +16,6 @@ require (
 	github.com/mattn/go-colorable v0.1.2 // indirect
 	github.com/mattn/go-isatty v0.0.8 // indirect
 	golang.org/x/sys v0.14.0 // indirect
-	golang.org/x/term v0.1.0 // indirect
+	golang.org/x/term v0.13.0 // indirect
 	gotest.tools/v3 v3.5.1 // indirect
 )
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ignoredPath reports whether a path relative to a local source matches one of the ignore globs. Globs
+// without a slash match any file or directory with that name, others match the whole relative path.
+func ignoredPath(rel string, ignore []string) bool {
+	for _, pattern := range ignore {
+		pattern = strings.Trim(pattern, "/")
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// walkTree visits everything in dir that is not ignored, skipping ignored directories as a whole
+func walkTree(dir string, ignore []string, fn func(path string, rel string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if ignoredPath(filepath.ToSlash(rel), ignore) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, rel, info)
+	})
+}
+
+// TreeHash summarizes the state of a directory tree from the names and modes of its entries and the sizes
+// and modification times of its files, which is cheap enough to compute on every run even for large trees
+func TreeHash(dir string, ignore []string) (string, error) {
+	hash := sha256.New()
+	if err := walkTree(dir, ignore, func(path string, rel string, info fs.FileInfo) error {
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", link)
+		case info.Mode().IsRegular():
+			// directory times change whenever an (ignored) file in them does, so only files count
+			fmt.Fprintf(hash, "%d\x00%d\x00", info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CopyTree copies everything in src that is not ignored to dest, keeping symlinks, permissions and
+// modification times so that build systems see the files as they are in src
+func CopyTree(src string, dest string, ignore []string) error {
+	dirs := make([]extractedDir, 0)
+	if err := walkTree(src, ignore, func(path string, rel string, info fs.FileInfo) error {
+		destPath := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(destPath, DEFAULT_FILE_PERM); err != nil {
+				return err
+			}
+			dirs = append(dirs, extractedDir{path: destPath, mode: info.Mode(), modTime: info.ModTime()})
+		case info.Mode()&os.ModeSymlink != 0:
+			return CopySymLink(path, destPath)
+		case info.Mode().IsRegular():
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			return writeFile(dest, destPath, in, info.Mode(), info.ModTime())
+		}
+		// sockets, fifos and devices do not belong in a source tree
+		return nil
+	}); err != nil {
+		return err
+	}
+	return finishDirs(dirs)
+}
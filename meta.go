@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TargetMeta is the state chariot keeps about a target between runs
+type TargetMeta struct {
+	Fingerprint string        `json:"fingerprint"`
+	Version     string        `json:"version,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Timings     []Timing      `json:"timings"`
+	Revision    *Revision     `json:"revision,omitempty"`
+}
+
+// Revision is the exact upstream revision a source was fetched at
+type Revision struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// Timing is the wall-clock time a single step of building a target took
+type Timing struct {
+	Step     string        `json:"step"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (cache ChariotCache) MetasPath() string {
+	return filepath.Join(cache.ProfilePath(), "meta")
+}
+
+func (cache ChariotCache) MetaPath(tag Tag) string {
+	return filepath.Join(cache.MetasPath(), tag.Dir()+".json")
+}
+
+func (cache ChariotCache) ReadMeta(tag Tag) (*TargetMeta, error) {
+	data, err := os.ReadFile(cache.MetaPath(tag))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta TargetMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (cache ChariotCache) WriteMeta(tag Tag, meta *TargetMeta) error {
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cache.MetaPath(tag)), DEFAULT_FILE_PERM); err != nil {
+		return err
+	}
+	return os.WriteFile(cache.MetaPath(tag), data, 0644)
+}
+
+// record stores how long a step that began at start took
+func (target *Target) record(step string, start time.Time) {
+	target.timings = append(target.timings, Timing{Step: step, Duration: time.Since(start)})
+}
+
+// Fingerprint hashes everything that influences the output of a target: its tag, its config
+// (commands, source url and type, modifiers), the project variables it uses and the fingerprints of
+// everything it depends on, which includes the sources it is built from and the sources its modifiers
+// take files from.
+func Fingerprint(tag Tag, config any, vars map[string]string, deps []*Target) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(tag.ToString()))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	// only variables the config mentions (directly or through other variables) count, changing one
+	// should not rebuild the whole project
+	used := make(map[string]bool)
+	mentions := string(data)
+	for changed := true; changed; {
+		changed = false
+		for name, value := range vars {
+			if !used[name] && strings.Contains(mentions, "$"+name) {
+				used[name] = true
+				mentions += "\x00" + value
+				changed = true
+			}
+		}
+	}
+	for _, name := range sortedKeys(vars) {
+		if !used[name] {
+			continue
+		}
+		hash.Write([]byte{0})
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write([]byte(vars[name]))
+	}
+	for _, dep := range deps {
+		hash.Write([]byte{0})
+		hash.Write([]byte(dep.tag.ToString()))
+		hash.Write([]byte{0})
+		hash.Write([]byte(dep.fingerprint))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
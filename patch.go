@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PATCH_OUTPUT_LINES is how many lines of the output of patch are kept in errors it does not explain
+const PATCH_OUTPUT_LINES = 5
+
+var (
+	patchFileRegex    = regexp.MustCompile(`^(?:patching|checking) file (.+)$`)
+	patchHunkRegex    = regexp.MustCompile(`^Hunk #(\d+) (FAILED|succeeded|ignored) at (\d+)(.*)$`)
+	patchMissingRegex = regexp.MustCompile(`^can't find file to patch at input line (\d+)$`)
+	patchHeaderRegex  = regexp.MustCompile(`^\|(?:\+\+\+|---) (\S+)`)
+	patchIgnoredRegex = regexp.MustCompile(`^(\d+) out of (\d+) hunks? ignored`)
+)
+
+// PatchError points at the hunk of a patch that did not apply cleanly
+type PatchError struct {
+	patch  string
+	file   string
+	hunk   string
+	reason string
+}
+
+type seriesEntry struct {
+	path  string
+	strip int
+}
+
+func (err *PatchError) Error() string {
+	if err.hunk == "" {
+		return fmt.Sprintf("patch %s %s", err.patch, err.reason)
+	}
+	return fmt.Sprintf("patch %s: hunk #%s of %s %s", err.patch, err.hunk, err.file, err.reason)
+}
+
+// readSeries lists the patches to apply in order. A directory applies its *.patch and *.diff files
+// sorted by name (or its `series` file if it has one), any other file is read as a quilt series file.
+func readSeries(path string, strip int) ([]seriesEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		if FileExists(filepath.Join(path, "series")) {
+			return readSeries(filepath.Join(path, "series"), strip)
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		series := make([]seriesEntry, 0)
+		for _, entry := range entries {
+			if entry.IsDir() || (!strings.HasSuffix(entry.Name(), ".patch") && !strings.HasSuffix(entry.Name(), ".diff")) {
+				continue
+			}
+			series = append(series, seriesEntry{path: filepath.Join(path, entry.Name()), strip: strip})
+		}
+		return series, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// a series line is a patch relative to the series file, optionally followed by its own -pN
+	series := make([]seriesEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := seriesEntry{path: filepath.Join(filepath.Dir(path), fields[0]), strip: strip}
+		for _, option := range fields[1:] {
+			level, ok := strings.CutPrefix(option, "-p")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unsupported patch option %s", path, line, option)
+			}
+			if entry.strip, err = strconv.Atoi(level); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid strip level %s", path, line, option)
+			}
+		}
+		series = append(series, entry)
+	}
+	return series, scanner.Err()
+}
+
+// applyPatch applies a single patch in dir. Unless fuzz is allowed, the patch is tried with --dry-run
+// first and rejected if any hunk only applies at an offset or with fuzz, so nothing is half applied.
+func (ctx *Context) applyPatch(runCtx context.Context, target *Target, dir string, path string, strip int, allowFuzz bool) error {
+	verboseWriter, _ := ctx.writers(target)
+	run := func(dryRun bool) (*exec.Cmd, string, error) {
+		args := []string{fmt.Sprintf("-p%d", strip), "--forward", "--batch", "-i", path}
+		if dryRun {
+			args = append(args, "--dry-run")
+		}
+		if !allowFuzz {
+			args = append(args, "--fuzz=0")
+		}
+
+		var out bytes.Buffer
+		cmd := exec.CommandContext(runCtx, "patch", args...)
+		cmd.Dir = dir
+		if verboseWriter != nil {
+			cmd.Stdout = io.MultiWriter(&out, verboseWriter)
+		} else {
+			cmd.Stdout = &out
+		}
+		cmd.Stderr = cmd.Stdout
+		err := cmd.Run()
+		return cmd, out.String(), err
+	}
+
+	name := filepath.Base(path)
+	if !allowFuzz {
+		cmd, out, err := run(true)
+		if patchErr := checkPatchOutput(name, out, allowFuzz); patchErr != nil {
+			return &PhaseError{phase: "modify", cmd: cmd.String(), err: patchErr}
+		}
+		if err != nil {
+			return &PhaseError{phase: "modify", cmd: cmd.String(), err: patchOutputError(err, out)}
+		}
+	}
+
+	cmd, out, err := run(false)
+	if err != nil {
+		if patchErr := checkPatchOutput(name, out, true); patchErr != nil {
+			return &PhaseError{phase: "modify", cmd: cmd.String(), err: patchErr}
+		}
+		return &PhaseError{phase: "modify", cmd: cmd.String(), err: patchOutputError(err, out)}
+	}
+	return nil
+}
+
+// patchOutputError adds the last lines of the output of patch to an error checkPatchOutput could not
+// explain, without --verbose the output is not shown anywhere else
+func patchOutputError(err error, out string) error {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	if len(lines) > PATCH_OUTPUT_LINES {
+		lines = lines[len(lines)-PATCH_OUTPUT_LINES:]
+	}
+	return fmt.Errorf("%w (%s)", err, strings.Join(lines, "; "))
+}
+
+// checkPatchOutput finds the first hunk in the output of patch that failed, or that needed an offset
+// or fuzz to apply when that is not allowed
+func checkPatchOutput(name string, out string, allowFuzz bool) error {
+	file := ""
+	// the line of the patch that names a file which could not be found
+	missing := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if match := patchFileRegex.FindStringSubmatch(line); match != nil {
+			file = strings.Trim(match[1], "'")
+			continue
+		}
+		if match := patchMissingRegex.FindStringSubmatch(line); match != nil {
+			file, missing = "", match[1]
+			continue
+		}
+		if match := patchHeaderRegex.FindStringSubmatch(line); match != nil && missing != "" {
+			// the +++ header names the file that was looked for, it comes after the --- one
+			file = match[1]
+			continue
+		}
+		if match := patchIgnoredRegex.FindStringSubmatch(line); match != nil {
+			if missing != "" {
+				return &PatchError{patch: name, file: file, reason: fmt.Sprintf("cannot find %s (input line %s), check strip", file, missing)}
+			}
+			return &PatchError{patch: name, file: file, reason: fmt.Sprintf("had %s out of %s hunk(s) of %s ignored", match[1], match[2], file)}
+		}
+		if strings.HasPrefix(line, "Reversed (or previously applied) patch detected") {
+			return &PatchError{patch: name, file: file, reason: fmt.Sprintf("is already applied to %s", file)}
+		}
+
+		match := patchHunkRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		switch {
+		case match[2] == "FAILED":
+			return &PatchError{patch: name, file: file, hunk: match[1], reason: fmt.Sprintf("failed at line %s", match[3])}
+		case !allowFuzz && slices.ContainsFunc([]string{"offset", "fuzz"}, func(s string) bool { return strings.Contains(match[4], s) }):
+			return &PatchError{patch: name, file: file, hunk: match[1], reason: fmt.Sprintf("only applies at line %s%s, set allow-fuzz to accept it", match[3], strings.TrimSuffix(match[4], "."))}
+		}
+	}
+	return nil
+}
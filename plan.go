@@ -0,0 +1,109 @@
+package main
+
+const (
+	REASON_REQUESTED  = "explicitly requested"
+	REASON_MISSING    = "missing from cache"
+	REASON_CHANGED    = "fingerprint changed"
+	REASON_DEPENDENCY = "dependency rebuilt"
+)
+
+type PlanEntry struct {
+	target *Target
+	reason string
+}
+
+// plan determines which targets have to be (re)built to bring the requested targets up to date. The
+// returned entries are ordered so that every target comes after the targets it depends on.
+func (ctx *Context) plan(requested []*Target) []PlanEntry {
+	order := make([]*Target, 0)
+	visited := make(map[*Target]bool)
+	reasons := make(map[*Target]string)
+
+	var visit func(target *Target)
+	visit = func(target *Target) {
+		if visited[target] {
+			return
+		}
+		visited[target] = true
+
+		for _, dep := range target.allDependencies() {
+			visit(dep)
+		}
+
+		switch {
+		case target.redo:
+			reasons[target] = REASON_REQUESTED
+		case !ctx.isBuilt(target):
+			reasons[target] = REASON_MISSING
+		case !ctx.isUpToDate(target):
+			reasons[target] = REASON_CHANGED
+		case ctx.options.rebuildDependents:
+			for _, dep := range target.allDependencies() {
+				if _, ok := reasons[dep]; ok {
+					reasons[target] = REASON_DEPENDENCY
+					break
+				}
+			}
+		}
+		order = append(order, target)
+	}
+	for _, target := range requested {
+		visit(target)
+	}
+
+	// targets that were built against a target that is about to be rebuilt are stale as well,
+	// order grows while iterating so that dependents of dependents get picked up too
+	if ctx.options.rebuildDependents {
+		for i := 0; i < len(order); i++ {
+			if _, ok := reasons[order[i]]; !ok {
+				continue
+			}
+			for _, dependent := range order[i].dependents {
+				if visited[dependent] || !ctx.isBuilt(dependent) {
+					continue
+				}
+				visit(dependent)
+			}
+		}
+	}
+
+	planned := make([]PlanEntry, 0)
+	for _, target := range order {
+		if reason, ok := reasons[target]; ok {
+			planned = append(planned, PlanEntry{target: target, reason: reason})
+		}
+	}
+	return planned
+}
+
+func (ctx *Context) printPlan(plan []PlanEntry) {
+	if len(plan) == 0 {
+		ctx.cli.Println("Nothing to build")
+		return
+	}
+	ctx.cli.Printf("Plan: %d target(s)\n", len(plan))
+	for i, entry := range plan {
+		ctx.cli.Printf("  %d. %s (%s)\n", i+1, entry.target.display(), entry.reason)
+	}
+}
+
+// isBuilt reports whether the target has output in the cache, regardless of whether it is up to date
+func (ctx *Context) isBuilt(target *Target) bool {
+	if target.tag.kind == "source" {
+		return FileExists(ctx.cache.SourcePath(target.tag.id))
+	}
+	return FileExists(ctx.cache.BuiltPath(target.tag.id, target.tag.kind == "host"))
+}
+
+// isUpToDate reports whether the target has been built and its fingerprint has not changed since
+func (ctx *Context) isUpToDate(target *Target) bool {
+	if !ctx.isBuilt(target) {
+		return false
+	}
+
+	meta, err := ctx.cache.ReadMeta(target.tag)
+	if err != nil {
+		return false
+	}
+	return meta.Fingerprint == target.fingerprint
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const REPORT_SLOWEST = 10
+
+// printReport shows the slowest of the given targets and the critical path through them, based on
+// the timings recorded the last time each target was built
+func (ctx *Context) printReport(targets []*Target) {
+	order := dependencyOrder(targets)
+
+	metas := make(map[*Target]*TargetMeta)
+	for _, target := range order {
+		meta, err := ctx.cache.ReadMeta(target.tag)
+		// a target that is being built, failed or was interrupted has no fingerprint, its meta only
+		// holds the timings of a previous build if any
+		if err != nil || meta.Fingerprint == "" {
+			continue
+		}
+		metas[target] = meta
+	}
+	if len(metas) == 0 {
+		ctx.cli.Println("No timings recorded")
+		return
+	}
+
+	slowest := make([]*Target, 0)
+	for _, target := range order {
+		if _, ok := metas[target]; ok {
+			slowest = append(slowest, target)
+		}
+	}
+	slices.SortStableFunc(slowest, func(a *Target, b *Target) int {
+		return cmp.Compare(metas[b].Duration, metas[a].Duration)
+	})
+	if len(slowest) > REPORT_SLOWEST {
+		slowest = slowest[:REPORT_SLOWEST]
+	}
+
+	ctx.cli.Println("Slowest targets:")
+	for _, target := range slowest {
+		meta := metas[target]
+		steps := make([]string, 0)
+		for _, timing := range meta.Timings {
+			steps = append(steps, fmt.Sprintf("%s %s", timing.Step, formatDuration(timing.Duration)))
+		}
+		ctx.cli.Printf("  %10s  %s (%s)\n", formatDuration(meta.Duration), target.tag.ToString(), strings.Join(steps, ", "))
+	}
+
+	// the critical path is the chain of dependencies with the longest total duration, it bounds how
+	// fast the targets can be built no matter how many jobs are used
+	finish := make(map[*Target]time.Duration)
+	via := make(map[*Target]*Target)
+	var last *Target
+	for _, target := range order {
+		var longest time.Duration
+		for _, dep := range target.allDependencies() {
+			if finish[dep] > longest || via[target] == nil {
+				longest = finish[dep]
+				via[target] = dep
+			}
+		}
+		finish[target] = longest
+		if meta, ok := metas[target]; ok {
+			finish[target] += meta.Duration
+		}
+		if last == nil || finish[target] > finish[last] {
+			last = target
+		}
+	}
+
+	path := make([]string, 0)
+	for target := last; target != nil; target = via[target] {
+		path = append([]string{target.tag.ToString()}, path...)
+	}
+	ctx.cli.Printf("Critical path (%s):\n", formatDuration(finish[last]))
+	ctx.cli.Printf("  %s\n", strings.Join(path, " -> "))
+}
+
+func formatDuration(duration time.Duration) string {
+	return duration.Round(time.Second).String()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const SPDX_NOASSERTION = "NOASSERTION"
+
+var SPDX_CHECKSUM_ALGORITHMS = map[string]string{
+	"sha256":  "SHA256",
+	"sha512":  "SHA512",
+	"blake2b": "BLAKE2b-512",
+}
+
+// SpdxDocument is the subset of an SPDX 2.3 document chariot fills in
+type SpdxDocument struct {
+	SpdxVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SpdxId            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SpdxCreationInfo   `json:"creationInfo"`
+	Packages          []SpdxPackage      `json:"packages"`
+	Relationships     []SpdxRelationship `json:"relationships"`
+}
+
+type SpdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type SpdxPackage struct {
+	Name             string         `json:"name"`
+	SpdxId           string         `json:"SPDXID"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	Homepage         string         `json:"homepage,omitempty"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []SpdxChecksum `json:"checksums,omitempty"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	LicenseDeclared  string         `json:"licenseDeclared"`
+	CopyrightText    string         `json:"copyrightText"`
+	SourceInfo       string         `json:"sourceInfo,omitempty"`
+}
+
+type SpdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type SpdxRelationship struct {
+	SpdxElementId      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+// spdxId returns the SPDX identifier of a target. SPDX only allows letters, digits, dots and dashes,
+// tag ids never contain dots so mapping underscores to them keeps every identifier unique.
+func spdxId(tag Tag) string {
+	kind := tag.kind
+	if kind == "" {
+		kind = "target"
+	}
+	return fmt.Sprintf("SPDXRef-%s-%s", kind, strings.ReplaceAll(tag.id, "_", "."))
+}
+
+// writeSbom writes an SPDX document describing the targets and every source that went into them
+func (ctx *Context) writeSbom(project string, targets []*Target, output string) error {
+	created := time.Now().UTC()
+	namespaceHash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s", project, created.Format(time.RFC3339Nano))))
+	document := SpdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SpdxId:            "SPDXRef-DOCUMENT",
+		Name:              project,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", neturl.PathEscape(project), hex.EncodeToString(namespaceHash[:8])),
+		CreationInfo: SpdxCreationInfo{
+			Created:  created.Format(time.RFC3339),
+			Creators: []string{"Tool: chariot"},
+		},
+		Packages:      make([]SpdxPackage, 0),
+		Relationships: make([]SpdxRelationship, 0),
+	}
+
+	for _, target := range targets {
+		if target.source != nil {
+			continue
+		}
+		document.Packages = append(document.Packages, SpdxPackage{
+			Name:             target.tag.id,
+			SpdxId:           spdxId(target.tag),
+			VersionInfo:      target.version,
+			DownloadLocation: SPDX_NOASSERTION,
+			LicenseConcluded: SPDX_NOASSERTION,
+			LicenseDeclared:  SPDX_NOASSERTION,
+			CopyrightText:    SPDX_NOASSERTION,
+		})
+	}
+
+	for _, target := range dependencyOrder(targets) {
+		if target.source == nil {
+			continue
+		}
+		document.Packages = append(document.Packages, ctx.sbomPackage(target.source))
+		patchSources := make(map[*Target]bool)
+		for _, modifier := range target.source.modifiers {
+			if modifier.source == nil || (modifier.modifierType != "patch" && modifier.modifierType != "patches") || patchSources[modifier.source] {
+				continue
+			}
+			patchSources[modifier.source] = true
+			document.Relationships = append(document.Relationships, SpdxRelationship{
+				SpdxElementId:      spdxId(modifier.source.tag),
+				RelationshipType:   "PATCH_APPLIED",
+				RelatedSpdxElement: spdxId(target.tag),
+			})
+		}
+	}
+
+	for _, target := range targets {
+		document.Relationships = append(document.Relationships, SpdxRelationship{
+			SpdxElementId:      document.SpdxId,
+			RelationshipType:   "DESCRIBES",
+			RelatedSpdxElement: spdxId(target.tag),
+		})
+		for _, dep := range dependencyOrder([]*Target{target}) {
+			if dep.source == nil || dep == target {
+				continue
+			}
+			document.Relationships = append(document.Relationships, SpdxRelationship{
+				SpdxElementId:      spdxId(target.tag),
+				RelationshipType:   "GENERATED_FROM",
+				RelatedSpdxElement: spdxId(dep.tag),
+			})
+		}
+	}
+
+	data, err := json.MarshalIndent(document, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+func (ctx *Context) sbomPackage(source *SourceTarget) SpdxPackage {
+	pkg := SpdxPackage{
+		Name:             source.tag.id,
+		SpdxId:           spdxId(source.tag),
+		VersionInfo:      source.version,
+		DownloadLocation: SPDX_NOASSERTION,
+		Homepage:         source.homepage,
+		LicenseConcluded: SPDX_NOASSERTION,
+		LicenseDeclared:  SPDX_NOASSERTION,
+		CopyrightText:    SPDX_NOASSERTION,
+	}
+	if source.license != "" {
+		pkg.LicenseDeclared = source.license
+	}
+
+	switch source.sourceType {
+	case "local":
+	case "git":
+		commit := source.git.commit
+		if meta, err := ctx.cache.ReadMeta(source.tag); err == nil && meta.Revision != nil {
+			commit = meta.Revision.Commit
+		}
+		pkg.DownloadLocation = "git+" + source.url
+		if commit != "" {
+			pkg.DownloadLocation += "@" + commit
+		}
+	default:
+		pkg.DownloadLocation = source.url
+		for _, checksum := range source.checksums {
+			pkg.Checksums = append(pkg.Checksums, SpdxChecksum{
+				Algorithm:     SPDX_CHECKSUM_ALGORITHMS[checksum.algorithm],
+				ChecksumValue: strings.ToLower(checksum.value),
+			})
+		}
+	}
+
+	patches := ctx.appliedPatches(source)
+	if len(patches) > 0 {
+		pkg.SourceInfo = fmt.Sprintf("patches applied: %s", strings.Join(patches, ", "))
+	}
+	return pkg
+}
+
+// appliedPatches lists the patches the modifiers of a source apply, series are expanded when the
+// source holding them has been prepared
+func (ctx *Context) appliedPatches(source *SourceTarget) []string {
+	patches := make([]string, 0)
+	for _, modifier := range source.modifiers {
+		switch modifier.modifierType {
+		case "patch":
+			patches = append(patches, modifier.file)
+		case "patches":
+			seriesPath := modifier.path
+			modSourcePath := filepath.Dir(modifier.path)
+			if modifier.source != nil {
+				modSourcePath = ctx.cache.SourcePath(modifier.source.tag.id)
+				seriesPath = filepath.Join(modSourcePath, modifier.file)
+			}
+			series, err := readSeries(seriesPath, modifier.strip)
+			if err != nil {
+				patches = append(patches, modifier.file)
+				continue
+			}
+			for _, entry := range series {
+				rel, err := filepath.Rel(modSourcePath, entry.path)
+				if err != nil {
+					rel = entry.path
+				}
+				patches = append(patches, rel)
+			}
+		}
+	}
+	return patches
+}
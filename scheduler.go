@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+type scheduleResult struct {
+	target *Target
+	err    error
+}
+
+// schedule builds the planned targets. Targets are started as soon as every one of their planned
+// dependencies has finished, with at most `jobs` targets running at once.
+func (ctx *Context) schedule(runCtx context.Context, plan []PlanEntry) error {
+	order := make([]*Target, 0)
+	planned := make(map[*Target]bool)
+	for _, entry := range plan {
+		order = append(order, entry.target)
+		planned[entry.target] = true
+	}
+
+	// a run that stops early must not leave any planned target looking up to date, least of all one that
+	// was only planned because a dependency is rebuilt
+	for _, target := range order {
+		if err := ctx.invalidate(target); err != nil {
+			return err
+		}
+	}
+
+	pending := make(map[*Target]int)
+	dependents := make(map[*Target][]*Target)
+	ready := make([]*Target, 0)
+	for _, target := range order {
+		for _, dep := range target.allDependencies() {
+			if !planned[dep] {
+				continue
+			}
+			pending[target]++
+			dependents[dep] = append(dependents[dep], target)
+		}
+		if pending[target] == 0 {
+			ready = append(ready, target)
+		}
+	}
+
+	jobs := int(ctx.options.jobs)
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	results := make(chan scheduleResult)
+	running := 0
+	finished := 0
+	built := make([]*Target, 0)
+	failed := make([]scheduleResult, 0)
+	skipped := make(map[*Target]*Target)
+	for finished < len(order) {
+		for len(ready) > 0 && running < jobs && (len(failed) == 0 || ctx.options.keepGoing) && runCtx.Err() == nil {
+			target := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- scheduleResult{target: target, err: ctx.run(runCtx, target)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		finished++
+		if result.err != nil {
+			failed = append(failed, result)
+
+			// nothing that depends on the failed target can be built anymore
+			var skip func(target *Target)
+			skip = func(target *Target) {
+				for _, dependent := range dependents[target] {
+					if _, ok := skipped[dependent]; ok {
+						continue
+					}
+					skipped[dependent] = result.target
+					finished++
+					skip(dependent)
+				}
+			}
+			skip(result.target)
+			continue
+		}
+		built = append(built, result.target)
+		for _, dependent := range dependents[result.target] {
+			pending[dependent]--
+			if _, ok := skipped[dependent]; !ok && pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if runCtx.Err() != nil {
+		return fmt.Errorf("build interrupted")
+	}
+	if ctx.options.keepGoing {
+		ctx.printSummary(order, built, failed, skipped)
+		if len(failed) > 0 {
+			return fmt.Errorf("%d target(s) failed", len(failed))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s: %w", failed[0].target.tag.ToString(), failed[0].err)
+	}
+
+	if finished < len(order) {
+		blocked := make([]string, 0)
+		for _, target := range order {
+			if pending[target] > 0 {
+				blocked = append(blocked, target.tag.ToString())
+			}
+		}
+		return fmt.Errorf("unable to schedule targets (%s)", strings.Join(blocked, ", "))
+	}
+	return nil
+}
+
+func (ctx *Context) printSummary(order []*Target, built []*Target, failed []scheduleResult, skipped map[*Target]*Target) {
+	ctx.cli.Printf("Summary: %d built, %d failed, %d skipped\n", len(built), len(failed), len(skipped))
+	for _, target := range built {
+		ctx.cli.Printf("  built   %s\n", target.tag.ToString())
+	}
+	for _, result := range failed {
+		ctx.cli.Printf("  failed  %s: %s\n", result.target.tag.ToString(), result.err)
+	}
+	for _, target := range order {
+		cause, ok := skipped[target]
+		if !ok {
+			continue
+		}
+		ctx.cli.Printf("  skipped %s (depends on %s)\n", target.tag.ToString(), cause.tag.ToString())
+	}
+}
+
+func (ctx *Context) run(runCtx context.Context, target *Target) error {
+	if ctx.options.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, ctx.options.timeout)
+		defer cancel()
+	}
+
+	// schedule already invalidated the meta
+	meta, err := ctx.cache.ReadMeta(target.tag)
+	if err != nil {
+		meta = &TargetMeta{}
+	}
+
+	ctx.cli.Printf(">> %s\n", target.display())
+	start := time.Now()
+	target.timings = make([]Timing, 0)
+	ctx.startOutput(target)
+	err = target.do(runCtx)
+	ctx.stopOutput(target)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %s: %w", ctx.options.timeout, err)
+		}
+		return err
+	}
+	meta.Fingerprint = target.fingerprint
+	meta.Duration = time.Since(start)
+	meta.Timings = target.timings
+	meta.Revision = target.revision
+	meta.Version = target.version
+	return ctx.cache.WriteMeta(target.tag, meta)
+}
+
+// invalidate clears the fingerprint of a target so that an interrupted build is never mistaken for an
+// up to date one. The rest of the meta is kept around as doers might need it (e.g. the revision a git
+// source was locked to).
+func (ctx *Context) invalidate(target *Target) error {
+	meta, err := ctx.cache.ReadMeta(target.tag)
+	if err != nil {
+		return nil
+	}
+	meta.Fingerprint = ""
+	return ctx.cache.WriteMeta(target.tag, meta)
+}
+
+// allDependencies returns the unique set of dependencies and runtime dependencies of the target
+func (target *Target) allDependencies() []*Target {
+	deps := make([]*Target, 0)
+	for _, list := range [][]*Target{target.dependencies, target.runtimeDependencies} {
+		for _, dep := range list {
+			if slices.Contains(deps, dep) {
+				continue
+			}
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// dependencyOrder returns the targets and everything they depend on, every target after its dependencies
+func dependencyOrder(targets []*Target) []*Target {
+	order := make([]*Target, 0)
+	visited := make(map[*Target]bool)
+	var visit func(target *Target)
+	visit = func(target *Target) {
+		if visited[target] {
+			return
+		}
+		visited[target] = true
+		for _, dep := range target.allDependencies() {
+			visit(dep)
+		}
+		order = append(order, target)
+	}
+	for _, target := range targets {
+		visit(target)
+	}
+	return order
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	neturl "net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -115,6 +119,24 @@ func CopySymLink(source string, dest string) error {
 	return os.Symlink(link, dest)
 }
 
+// UrlBase returns the last element of the path of a url
+func UrlBase(url string) string {
+	if parsed, err := neturl.Parse(url); err == nil {
+		return path.Base(parsed.Path)
+	}
+	return path.Base(url)
+}
+
+// sortedKeys returns the keys of a map in order, so iterating over it is deterministic
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
 func ArrIncludes(arr []string, str string) bool {
 	return slices.ContainsFunc(arr, func(e string) bool {
 		return e == str
@@ -158,6 +180,14 @@ func StringsToTags(tags []string) ([]Tag, error) {
 	return ntags, nil
 }
 
+// Dir returns a relative path that uniquely identifies the tag
+func (tag Tag) Dir() string {
+	if tag.kind == "" {
+		return filepath.Join("target", tag.id)
+	}
+	return filepath.Join(tag.kind, tag.id)
+}
+
 func (tag Tag) ToString() string {
 	if tag.kind == "" {
 		return tag.id
@@ -165,38 +195,82 @@ func (tag Tag) ToString() string {
 	return fmt.Sprintf("%s:%s", tag.kind, tag.id)
 }
 
-type ChariotCache string
+type ChariotCache struct {
+	path      string
+	distfiles string
+	profile   string
+}
+
+// CreateCache creates a cache at path, downloaded files are kept in distfiles which can be shared
+// between projects. An empty distfiles keeps them inside of the cache. Everything that is built is
+// kept apart per profile, the container and downloads are shared.
+func CreateCache(path string, distfiles string, profile string) ChariotCache {
+	if distfiles == "" {
+		distfiles = filepath.Join(path, "distfiles")
+	}
+	return ChariotCache{path: path, distfiles: distfiles, profile: profile}
+}
 
 func (cache ChariotCache) Path() string {
-	return string(cache)
+	return cache.path
+}
+
+// ProfilePath is where the artifacts of the selected profile are kept
+func (cache ChariotCache) ProfilePath() string {
+	if cache.profile == "" {
+		return cache.path
+	}
+	return filepath.Join(cache.path, "profile", cache.profile)
+}
+
+func (cache ChariotCache) DistfilesPath() string {
+	return cache.distfiles
+}
+
+// DistfilePath is where the file downloaded from url is kept. The checksums are part of the key so
+// that a changed checksum never matches an old download.
+func (cache ChariotCache) DistfilePath(url string, checksums []Checksum) string {
+	hash := sha256.New()
+	hash.Write([]byte(url))
+	for _, checksum := range checksums {
+		hash.Write([]byte{0})
+		hash.Write([]byte(checksum.algorithm + ":" + strings.ToLower(checksum.value)))
+	}
+
+	return filepath.Join(cache.DistfilesPath(), fmt.Sprintf("%s-%s", hex.EncodeToString(hash.Sum(nil))[:16], UrlBase(url)))
 }
 
 func (cache ChariotCache) ContainerPath() string {
 	return filepath.Join(cache.Path(), "container")
 }
 
-func (cache ChariotCache) SysrootPath() string {
-	return filepath.Join(cache.Path(), "root")
+func (cache ChariotCache) SysrootPath(tag Tag) string {
+	return filepath.Join(cache.ProfilePath(), "root", tag.Dir())
 }
 
-func (cache ChariotCache) HostPath() string {
-	return filepath.Join(cache.Path(), "hostroot")
+func (cache ChariotCache) HostPath(tag Tag) string {
+	return filepath.Join(cache.ProfilePath(), "hostroot", tag.Dir())
 }
 
 func (cache ChariotCache) SourcesPath() string {
-	return filepath.Join(cache.Path(), "sources")
+	return filepath.Join(cache.ProfilePath(), "sources")
 }
 
 func (cache ChariotCache) SourcePath(id string) string {
 	return filepath.Join(cache.SourcesPath(), id)
 }
 
+// GitSnapshotPath is where a checkout of a git repository at a ref is kept for offline use
+func (cache ChariotCache) GitSnapshotPath(revisionRef string) string {
+	return cache.DistfilePath(revisionRef, nil) + ".tar.gz"
+}
+
 func (cache ChariotCache) BuildsPath(host bool) string {
 	sub := "build"
 	if host {
 		sub = "host-build"
 	}
-	return filepath.Join(cache.Path(), sub)
+	return filepath.Join(cache.ProfilePath(), sub)
 }
 
 func (cache ChariotCache) BuildPath(id string, host bool) string {
@@ -208,7 +282,7 @@ func (cache ChariotCache) BuiltsPath(host bool) string {
 	if host {
 		sub = "host-built"
 	}
-	return filepath.Join(cache.Path(), sub)
+	return filepath.Join(cache.ProfilePath(), sub)
 }
 
 func (cache ChariotCache) BuiltPath(id string, host bool) string {
@@ -219,9 +293,15 @@ func (cache ChariotCache) Init() error {
 	if err := os.MkdirAll(cache.Path(), 0755); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(cache.ProfilePath(), 0755); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(cache.SourcesPath(), 0755); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(cache.DistfilesPath(), 0755); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(cache.BuildsPath(false), 0755); err != nil {
 		return err
 	}
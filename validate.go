@@ -0,0 +1,696 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	SOURCE_TYPES   = append(slices.Clone(ARCHIVE_TYPES), "local", "git")
+	MODIFIER_TYPES = []string{"patch", "patches", "merge", "exec"}
+	BUILTIN_VARS   = []string{"THREADS", "PREFIX", "ROOT", "VERSION", "SOURCE", "BUILD", "INSTALL"}
+
+	dependencyRegex = regexp.MustCompile(`^((?:source|host):)?[a-z\-1-9]+$`)
+	nameRegex       = regexp.MustCompile(`^[a-z0-9\-_]+$`)
+	varNameRegex    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ConfigError is a problem with a key of the config, line is 0 if it is not known
+type ConfigError struct {
+	file    string
+	line    int
+	key     string
+	message string
+}
+
+// ConfigErrors collects every problem found in a config so they can all be fixed in one go
+type ConfigErrors []*ConfigError
+
+// configLines maps the keys of a toml document to the lines they are defined on. It only understands
+// as much toml as is needed to point at keys, the document is parsed by the decoder beforehand.
+type configLines struct {
+	keys     map[string]int
+	elements map[string][]int
+}
+
+// configOrigin is the file a config entry was declared in
+type configOrigin struct {
+	path  string
+	lines *configLines
+}
+
+type configFrame struct {
+	key     string
+	inTable bool
+}
+
+func (err *ConfigError) Error() string {
+	location := err.file
+	if err.line > 0 {
+		location = fmt.Sprintf("%s:%d", err.file, err.line)
+	}
+	if err.key == "" {
+		return fmt.Sprintf("%s: %s", location, err.message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, err.key, err.message)
+}
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, 0)
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// decodeConfig decodes a config file and checks it against the rules of chariot-schema.json. Only the
+// root config may set the project, the others are included by it. A config that decodes but breaks the
+// rules is returned along with its errors, so the files it includes can still be checked.
+func decodeConfig(path string, root bool) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	md, err := toml.Decode(string(data), &cfg)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			// the message without the position, which is reported on its own
+			position := parseErr
+			position.LastKey = ""
+			message := strings.TrimPrefix(position.Error(), fmt.Sprintf("toml: line %d: ", position.Position.Line))
+			return nil, ConfigErrors{{file: path, line: parseErr.Position.Line, key: parseErr.LastKey, message: message}}
+		}
+		// type errors are not parse errors, their message already tells the line and key
+		return nil, ConfigErrors{{file: path, message: strings.TrimPrefix(err.Error(), "toml: ")}}
+	}
+
+	origin := &configOrigin{path: path, lines: locateConfigKeys(string(data))}
+	cfg.origin = origin
+	for id, source := range cfg.Source {
+		source.origin = origin
+		cfg.Source[id] = source
+	}
+	for id, host := range cfg.Host {
+		host.origin = origin
+		cfg.Host[id] = host
+	}
+	for id, target := range cfg.Target {
+		target.origin = origin
+		cfg.Target[id] = target
+	}
+	for name, template := range cfg.Template {
+		template.origin = origin
+		cfg.Template[name] = template
+	}
+	for name, profile := range cfg.Profile {
+		profile.origin = origin
+		for _, targets := range []map[string]ConfigProfileTarget{profile.Source, profile.Host, profile.Target} {
+			for id, target := range targets {
+				target.origin = origin
+				targets[id] = target
+			}
+		}
+		cfg.Profile[name] = profile
+	}
+
+	if errs := validateConfig(origin, &cfg, md, root); len(errs) > 0 {
+		return &cfg, errs
+	}
+	return &cfg, nil
+}
+
+func validateConfig(origin *configOrigin, cfg *Config, md toml.MetaData, root bool) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	report := func(line int, key string, format string, a ...any) {
+		errs = append(errs, &ConfigError{file: origin.path, line: line, key: key, message: fmt.Sprintf(format, a...)})
+	}
+	keyError := func(key []string, format string, a ...any) {
+		report(origin.lines.line(key), strings.Join(key, "."), format, a...)
+	}
+	dependencies := func(key []string, deps []string) {
+		for _, dep := range deps {
+			if !dependencyRegex.MatchString(dep) {
+				keyError(key, "invalid dependency %s", dep)
+			}
+		}
+	}
+
+	names := func(key []string, values map[string]string) {
+		for _, name := range sortedKeys(values) {
+			switch {
+			case !varNameRegex.MatchString(name):
+				keyError(append(key, name), "invalid name, expected letters, digits and underscores")
+			case key[len(key)-1] == "vars" && slices.Contains(BUILTIN_VARS, name):
+				keyError(append(key, name), "%s is a built-in variable", name)
+			}
+		}
+	}
+
+	for _, key := range md.Undecoded() {
+		keyError(key, "unknown key")
+	}
+	names([]string{"project", "vars"}, cfg.Project.Vars)
+
+	switch {
+	case root && cfg.Project.Name == "":
+		keyError([]string{"project", "name"}, "missing required key")
+	case !root && md.IsDefined("project"):
+		keyError([]string{"project"}, "can only be set in the root config")
+	}
+
+	for id, source := range cfg.Source {
+		key := func(parts ...string) []string {
+			return append([]string{"source", id}, parts...)
+		}
+		if _, err := CreateTag(id, "source"); err != nil {
+			keyError(key(), "%s", err)
+		}
+
+		switch {
+		case source.Type == "":
+			keyError(key("type"), "missing required key")
+		case !slices.Contains(SOURCE_TYPES, source.Type):
+			keyError(key("type"), "invalid source type %s, expected one of %s", source.Type, strings.Join(SOURCE_TYPES, ", "))
+		}
+		if source.Url == "" {
+			keyError(key("url"), "missing required key")
+		}
+		if source.StripComponents != nil && *source.StripComponents < 0 {
+			keyError(key("strip-components"), "must not be negative")
+		}
+		if source.Depth < 0 {
+			keyError(key("depth"), "must not be negative")
+		}
+
+		if source.Type != "git" {
+			for _, field := range []string{"commit", "tag", "branch", "depth", "submodules"} {
+				if md.IsDefined(key(field)...) {
+					keyError(key(field), "only applies to git sources")
+				}
+			}
+		}
+		if source.Type == "git" || source.Type == "local" {
+			for _, field := range []string{"sha256", "sha512", "blake2b", "strip-components"} {
+				if md.IsDefined(key(field)...) {
+					keyError(key(field), "only applies to archive sources")
+				}
+			}
+		}
+		if source.Type != "local" && md.IsDefined(key("ignore")...) {
+			keyError(key("ignore"), "only applies to local sources")
+		}
+		if n := len(slices.DeleteFunc([]string{source.Commit, source.Tag, source.Branch}, func(ref string) bool { return ref == "" })); n > 1 {
+			keyError(key(), "only one of commit, tag and branch can be set")
+		}
+
+		dependencies(key("dependencies"), source.Dependencies)
+		names(key("vars"), source.Vars)
+		names(key("env"), source.Env)
+
+		for i, modifier := range source.Modifiers {
+			modifierKey := strings.Join(key("modifiers"), ".")
+			modifierError := func(format string, a ...any) {
+				report(origin.lines.element(key("modifiers"), i), fmt.Sprintf("%s[%d]", modifierKey, i), format, a...)
+			}
+
+			if modifier.Type == "" {
+				modifierError("missing required key type")
+				continue
+			}
+			if !slices.Contains(MODIFIER_TYPES, modifier.Type) {
+				modifierError("invalid modifier type %s, expected one of %s", modifier.Type, strings.Join(MODIFIER_TYPES, ", "))
+				continue
+			}
+
+			// every modifier type needs exactly the fields it uses, anything else is most likely a mistake
+			fields := map[string]bool{
+				"source":     modifier.Source != "",
+				"file":       modifier.File != "",
+				"cmd":        modifier.Cmd != "",
+				"strip":      modifier.Strip != nil,
+				"allow-fuzz": modifier.AllowFuzz,
+			}
+			required := map[string][]string{
+				"patch":   {"file"},
+				"patches": {"file"},
+				"merge":   {"source"},
+				"exec":    {"cmd"},
+			}[modifier.Type]
+			optional := map[string][]string{
+				"patch":   {"source", "strip"},
+				"patches": {"source", "strip", "allow-fuzz"},
+				"exec":    {"source"},
+			}[modifier.Type]
+			for _, field := range []string{"source", "file", "cmd", "strip", "allow-fuzz"} {
+				switch {
+				case slices.Contains(required, field) && !fields[field]:
+					modifierError("missing required key %s for %s modifiers", field, modifier.Type)
+				case !slices.Contains(required, field) && !slices.Contains(optional, field) && fields[field]:
+					modifierError("%s does not apply to %s modifiers", field, modifier.Type)
+				}
+			}
+
+			if modifier.Strip != nil && *modifier.Strip < 0 {
+				modifierError("strip must not be negative")
+			}
+			if modifier.Source != "" {
+				if _, err := CreateTag(modifier.Source, "source"); err != nil {
+					modifierError("%s", err)
+				}
+			} else if modifier.File != "" && !FileExists(origin.resolve(modifier.File)) {
+				modifierError("%s does not exist", origin.resolve(modifier.File))
+			}
+		}
+	}
+
+	common := func(kind string, id string, target ConfigStandardTarget) {
+		key := func(parts ...string) []string {
+			return append([]string{kind, id}, parts...)
+		}
+		switch kind {
+		case "template":
+			if !nameRegex.MatchString(id) {
+				keyError(key(), "invalid template name, expected lowercase letters, digits, dashes and underscores")
+			}
+			if md.IsDefined(key("version")...) {
+				keyError(key("version"), "does not apply to templates")
+			}
+		default:
+			tagKind := kind
+			if kind == "target" {
+				tagKind = ""
+			}
+			if _, err := CreateTag(id, tagKind); err != nil {
+				keyError(key(), "%s", err)
+			}
+			// a target that extends a template can inherit install, that is checked once templates are resolved
+			if target.Extends == "" && !md.IsDefined(key("install")...) {
+				keyError(key("install"), "missing required key")
+			}
+		}
+		if target.Extends == "" && md.IsDefined(key("append")...) {
+			keyError(key("append"), "only applies to targets that extend a template")
+		}
+		if kind == "target" && md.IsDefined(key("append", "runtime-dependencies")...) {
+			keyError(key("append", "runtime-dependencies"), "only applies to host targets")
+		}
+		dependencies(key("dependencies"), target.Dependencies)
+		dependencies(key("append", "dependencies"), target.Append.Dependencies)
+		dependencies(key("append", "runtime-dependencies"), target.Append.RuntimeDependencies)
+		names(key("vars"), target.Vars)
+		names(key("env"), target.Env)
+	}
+	for id, host := range cfg.Host {
+		common("host", id, host.ConfigStandardTarget)
+		dependencies([]string{"host", id, "runtime-dependencies"}, host.RuntimeDependencies)
+	}
+	for id, target := range cfg.Target {
+		common("target", id, target)
+	}
+	for name, template := range cfg.Template {
+		common("template", name, template.ConfigStandardTarget)
+		dependencies([]string{"template", name, "runtime-dependencies"}, template.RuntimeDependencies)
+	}
+
+	for name, profile := range cfg.Profile {
+		if !nameRegex.MatchString(name) {
+			keyError([]string{"profile", name}, "invalid profile name, expected lowercase letters, digits, dashes and underscores")
+		}
+		names([]string{"profile", name, "vars"}, profile.Vars)
+
+		// only what does not change the kind of a target can be overridden
+		fields := map[string][]string{
+			"source": {"configure", "build", "install", "runtime-dependencies"},
+			"host":   {},
+			"target": {"runtime-dependencies"},
+		}
+		for kind, targets := range map[string]map[string]ConfigProfileTarget{"source": profile.Source, "host": profile.Host, "target": profile.Target} {
+			for id, target := range targets {
+				key := func(parts ...string) []string {
+					return append([]string{"profile", name, kind, id}, parts...)
+				}
+				for _, field := range fields[kind] {
+					if md.IsDefined(key(field)...) {
+						keyError(key(field), "cannot be overridden for %s targets", kind)
+					}
+				}
+				if target.Dependencies != nil {
+					dependencies(key("dependencies"), *target.Dependencies)
+				}
+				if target.RuntimeDependencies != nil {
+					dependencies(key("runtime-dependencies"), *target.RuntimeDependencies)
+				}
+				names(key("vars"), target.Vars)
+				names(key("env"), target.Env)
+			}
+		}
+	}
+
+	errs.sort()
+	return errs
+}
+
+// validateReferences checks that every target the merged config refers to is defined somewhere
+func (cfg *Config) validateReferences() ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	dependencies := func(origin *configOrigin, key []string, deps []string) {
+		for _, dep := range deps {
+			if tag, err := StringToTag(dep); err == nil && !cfg.defines(tag) {
+				errs = append(errs, &ConfigError{file: origin.path, line: origin.lines.line(key), key: strings.Join(key, "."), message: fmt.Sprintf("undefined dependency %s", dep)})
+			}
+		}
+	}
+
+	for id, source := range cfg.Source {
+		dependencies(source.origin, []string{"source", id, "dependencies"}, source.Dependencies)
+		for i, modifier := range source.Modifiers {
+			if modifier.Source == "" || cfg.defines(Tag{id: modifier.Source, kind: "source"}) {
+				continue
+			}
+			key := []string{"source", id, "modifiers"}
+			errs = append(errs, &ConfigError{
+				file:    source.origin.path,
+				line:    source.origin.lines.element(key, i),
+				key:     fmt.Sprintf("%s[%d]", strings.Join(key, "."), i),
+				message: fmt.Sprintf("undefined source %s", modifier.Source),
+			})
+		}
+	}
+	standard := func(kind string, id string, target ConfigStandardTarget) {
+		dependencies(target.origin, []string{kind, id, "dependencies"}, target.Dependencies)
+		dependencies(target.origin, []string{kind, id, "append", "dependencies"}, target.Append.Dependencies)
+		dependencies(target.origin, []string{kind, id, "append", "runtime-dependencies"}, target.Append.RuntimeDependencies)
+	}
+	for id, host := range cfg.Host {
+		standard("host", id, host.ConfigStandardTarget)
+		dependencies(host.origin, []string{"host", id, "runtime-dependencies"}, host.RuntimeDependencies)
+	}
+	for id, target := range cfg.Target {
+		standard("target", id, target)
+	}
+	for name, template := range cfg.Template {
+		standard("template", name, template.ConfigStandardTarget)
+		dependencies(template.origin, []string{"template", name, "runtime-dependencies"}, template.RuntimeDependencies)
+	}
+
+	for name, profile := range cfg.Profile {
+		for kind, targets := range map[string]map[string]ConfigProfileTarget{"source": profile.Source, "host": profile.Host, "target": profile.Target} {
+			tagKind := kind
+			if kind == "target" {
+				tagKind = ""
+			}
+			for id, target := range targets {
+				key := []string{"profile", name, kind, id}
+				if !cfg.defines(Tag{id: id, kind: tagKind}) {
+					errs = append(errs, &ConfigError{file: target.origin.path, line: target.origin.lines.line(key), key: strings.Join(key, "."), message: fmt.Sprintf("undefined %s %s", kind, id)})
+				}
+				if target.Dependencies != nil {
+					dependencies(target.origin, append(key, "dependencies"), *target.Dependencies)
+				}
+				if target.RuntimeDependencies != nil {
+					dependencies(target.origin, append(key, "runtime-dependencies"), *target.RuntimeDependencies)
+				}
+			}
+		}
+	}
+
+	errs.sort()
+	return errs
+}
+
+// validateCycles reports every dependency cycle, following dependencies, runtime dependencies and the
+// sources of modifiers like BuildTargets does
+func (cfg *Config) validateCycles() ConfigErrors {
+	type edges struct {
+		origin *configOrigin
+		key    []string
+		tags   []Tag
+	}
+	graph := make(map[Tag]edges)
+	add := func(tag Tag, origin *configOrigin, key []string, deps ...[]string) {
+		tags := make([]Tag, 0)
+		for _, list := range deps {
+			for _, dep := range list {
+				// invalid and undefined dependencies are reported on their own
+				if depTag, err := StringToTag(dep); err == nil && cfg.defines(depTag) {
+					tags = append(tags, depTag)
+				}
+			}
+		}
+		graph[tag] = edges{origin: origin, key: key, tags: tags}
+	}
+	for id, source := range cfg.Source {
+		modifierSources := make([]string, 0)
+		for _, modifier := range source.Modifiers {
+			if modifier.Source != "" {
+				modifierSources = append(modifierSources, "source:"+modifier.Source)
+			}
+		}
+		add(Tag{id: id, kind: "source"}, source.origin, []string{"source", id, "dependencies"}, source.Dependencies, modifierSources)
+	}
+	for id, host := range cfg.Host {
+		add(Tag{id: id, kind: "host"}, host.origin, []string{"host", id, "dependencies"}, host.Dependencies, host.RuntimeDependencies)
+	}
+	for id, target := range cfg.Target {
+		add(Tag{id: id, kind: ""}, target.origin, []string{"target", id, "dependencies"}, target.Dependencies)
+	}
+
+	errs := make(ConfigErrors, 0)
+	done := make(map[Tag]bool)
+	// tags that are currently being visited, any of them being reached again means there is a cycle
+	visiting := make([]Tag, 0)
+	var visit func(tag Tag)
+	visit = func(tag Tag) {
+		if i := slices.Index(visiting, tag); i >= 0 {
+			cycle := make([]string, 0)
+			for _, cycleTag := range visiting[i:] {
+				cycle = append(cycle, cycleTag.ToString())
+			}
+			cycle = append(cycle, tag.ToString())
+			start := graph[tag]
+			errs = append(errs, &ConfigError{file: start.origin.path, line: start.origin.lines.line(start.key), key: strings.Join(start.key, "."), message: fmt.Sprintf("dependency cycle (%s)", strings.Join(cycle, " -> "))})
+			return
+		}
+		if done[tag] {
+			return
+		}
+		visiting = append(visiting, tag)
+		for _, dep := range graph[tag].tags {
+			visit(dep)
+		}
+		visiting = visiting[:len(visiting)-1]
+		done[tag] = true
+	}
+
+	tags := make([]Tag, 0, len(graph))
+	for tag := range graph {
+		tags = append(tags, tag)
+	}
+	// a stable order reports the same cycle the same way every time
+	slices.SortFunc(tags, func(a Tag, b Tag) int {
+		return cmp.Compare(a.ToString(), b.ToString())
+	})
+	for _, tag := range tags {
+		visit(tag)
+	}
+
+	errs.sort()
+	return errs
+}
+
+// sort orders the errors by file and line, targets are kept in maps so this keeps reports stable
+func (errs ConfigErrors) sort() {
+	slices.SortFunc(errs, func(a *ConfigError, b *ConfigError) int {
+		if a.file != b.file {
+			return cmp.Compare(a.file, b.file)
+		}
+		if a.line != b.line {
+			return cmp.Compare(a.line, b.line)
+		}
+		if a.key != b.key {
+			return cmp.Compare(a.key, b.key)
+		}
+		return cmp.Compare(a.message, b.message)
+	})
+}
+
+// resolve makes a path that is relative to the file the entry was declared in absolute
+func (origin *configOrigin) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	dir, err := filepath.Abs(filepath.Dir(origin.path))
+	if err != nil {
+		dir = filepath.Dir(origin.path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// defines reports whether the config has a target for the tag
+func (cfg *Config) defines(tag Tag) bool {
+	switch tag.kind {
+	case "source":
+		_, ok := cfg.Source[tag.id]
+		return ok
+	case "host":
+		_, ok := cfg.Host[tag.id]
+		return ok
+	default:
+		_, ok := cfg.Target[tag.id]
+		return ok
+	}
+}
+
+func locateConfigKeys(data string) *configLines {
+	lines := &configLines{keys: make(map[string]int), elements: make(map[string][]int)}
+	define := func(key string, line int) {
+		if _, ok := lines.keys[key]; !ok {
+			lines.keys[key] = line
+		}
+	}
+
+	table := ""
+	valueKey := ""
+	expectKey := true
+	stack := make([]configFrame, 0)
+	line := 1
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			if len(stack) == 0 {
+				expectKey = true
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case expectKey && len(stack) == 0 && c == '[':
+			end := strings.IndexByte(data[i:], '\n')
+			if end < 0 {
+				end = len(data) - i
+			}
+			header := strings.TrimSpace(data[i : i+end])
+			if cut := strings.LastIndex(header, "]"); cut >= 0 {
+				header = header[:cut+1]
+			}
+			arrayTable := strings.HasPrefix(header, "[[")
+			table = joinConfigKey("", strings.Trim(header, "[] \t"))
+			define(table, line)
+			if arrayTable {
+				lines.elements[table] = append(lines.elements[table], line)
+			}
+			i += end - 1
+		case expectKey:
+			// read up to the '=', skipping over quoted parts of the key
+			start := i
+			for i < len(data) && data[i] != '=' && data[i] != '\n' {
+				if data[i] == '"' || data[i] == '\'' {
+					i, _ = skipConfigString(data, i)
+				}
+				i++
+			}
+			base := table
+			if len(stack) > 0 {
+				base = stack[len(stack)-1].key
+			}
+			valueKey = joinConfigKey(base, data[start:i])
+			define(valueKey, line)
+			expectKey = false
+			if i < len(data) && data[i] == '\n' {
+				i--
+			}
+		case c == '"' || c == '\'':
+			end, newlines := skipConfigString(data, i)
+			i, line = end, line+newlines
+		case c == '[' || c == '{':
+			key := valueKey
+			if len(stack) > 0 && !stack[len(stack)-1].inTable {
+				key = stack[len(stack)-1].key
+				if c == '{' {
+					lines.elements[key] = append(lines.elements[key], line)
+				}
+			}
+			stack = append(stack, configFrame{key: key, inTable: c == '{'})
+			expectKey = c == '{'
+		case c == ']' || c == '}':
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case c == ',':
+			expectKey = len(stack) > 0 && stack[len(stack)-1].inTable
+		}
+	}
+	return lines
+}
+
+// skipConfigString returns the index of the closing quote of the string starting at start and the
+// number of newlines in it
+func skipConfigString(data string, start int) (int, int) {
+	quote := data[start]
+	delimiter := string(quote)
+	if strings.HasPrefix(data[start:], strings.Repeat(delimiter, 3)) {
+		delimiter = strings.Repeat(delimiter, 3)
+	}
+
+	newlines := 0
+	for i := start + len(delimiter); i < len(data); i++ {
+		switch {
+		case data[i] == '\\' && quote == '"':
+			if i+1 < len(data) && data[i+1] == '\n' {
+				newlines++
+			}
+			i++
+		case data[i] == '\n':
+			if len(delimiter) == 1 {
+				return i - 1, newlines
+			}
+			newlines++
+		case strings.HasPrefix(data[i:], delimiter):
+			return i + len(delimiter) - 1, newlines
+		}
+	}
+	return len(data) - 1, newlines
+}
+
+func joinConfigKey(base string, key string) string {
+	parts := make([]string, 0)
+	if base != "" {
+		parts = append(parts, base)
+	}
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return strings.Join(parts, ".")
+}
+
+// line finds the line a key is defined on, falling back to the closest parent that is defined
+func (lines *configLines) line(key []string) int {
+	for i := len(key); i > 0; i-- {
+		if line, ok := lines.keys[strings.Join(key[:i], ".")]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// element finds the line the index-th table in an array of tables starts on
+func (lines *configLines) element(key []string, index int) int {
+	if elements := lines.elements[strings.Join(key, ".")]; index < len(elements) {
+		return elements[index]
+	}
+	return lines.line(key)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const VENDOR_MANIFEST = "manifest.json"
+
+// VendorManifest describes the prepared sources in a vendor bundle and where they came from
+type VendorManifest struct {
+	Sources []VendorSource `json:"sources"`
+}
+
+type VendorSource struct {
+	Id        string            `json:"id"`
+	Version   string            `json:"version,omitempty"`
+	Type      string            `json:"type"`
+	Url       string            `json:"url"`
+	Ref       string            `json:"ref,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Revision  *Revision         `json:"revision,omitempty"`
+	Modifiers []VendorModifier  `json:"modifiers"`
+	Tree      string            `json:"tree"`
+}
+
+type VendorModifier struct {
+	Type      string `json:"type"`
+	Source    string `json:"source,omitempty"`
+	File      string `json:"file,omitempty"`
+	Cmd       string `json:"cmd,omitempty"`
+	Strip     int    `json:"strip,omitempty"`
+	AllowFuzz bool   `json:"allow-fuzz,omitempty"`
+	// hashes of the patches a modifier applies when they do not come from a source
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// VendorBundle is a vendor bundle that sources are taken from instead of their upstream
+type VendorBundle struct {
+	path    string
+	sources map[string]VendorSource
+}
+
+// ContentHash hashes the names, modes and contents of everything in a directory tree. Unlike TreeHash
+// it does not depend on modification times, so it identifies a tree across machines.
+func ContentHash(dir string) (string, error) {
+	hash := sha256.New()
+	if err := walkTree(dir, nil, func(path string, rel string, info fs.FileInfo) error {
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", link)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			fmt.Fprintf(hash, "%d\x00", info.Size())
+			if _, err := io.Copy(hash, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// vendorSources writes the prepared sources to output, a directory or a .tar.gz tarball, together with
+// a manifest of where each source came from and what was done to it
+func (ctx *Context) vendorSources(sources []*SourceTarget, output string) error {
+	tarball := strings.HasSuffix(output, ".tar.gz")
+	bundlePath := output
+	if tarball {
+		bundlePath = filepath.Join(ctx.cache.ProfilePath(), "vendor-staging")
+		if err := os.RemoveAll(bundlePath); err != nil {
+			return err
+		}
+		defer os.RemoveAll(bundlePath)
+	} else if entries, err := os.ReadDir(output); err == nil && len(entries) > 0 {
+		// only ever replace a previous bundle, the output could just as well be a typo for something important
+		if !FileExists(filepath.Join(output, VENDOR_MANIFEST)) {
+			return fmt.Errorf("%s is not empty and not a vendor bundle", output)
+		}
+		if err := os.RemoveAll(output); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(bundlePath, DEFAULT_FILE_PERM); err != nil {
+		return err
+	}
+
+	manifest := VendorManifest{Sources: make([]VendorSource, 0)}
+	for _, source := range sources {
+		task := ctx.cli.StartTask("Vendoring %s", source.tag.ToString())
+		entry, err := ctx.vendorSource(source, filepath.Join(bundlePath, source.tag.id))
+		task.Stop()
+		if err != nil {
+			return fmt.Errorf("failed to vendor %s: %w", source.tag.ToString(), err)
+		}
+		manifest.Sources = append(manifest.Sources, *entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(bundlePath, VENDOR_MANIFEST), data, 0644); err != nil {
+		return err
+	}
+
+	if tarball {
+		return WriteTarball(bundlePath, output)
+	}
+	return nil
+}
+
+func (ctx *Context) vendorSource(source *SourceTarget, dest string) (*VendorSource, error) {
+	sourcePath := ctx.cache.SourcePath(source.tag.id)
+	if err := os.MkdirAll(dest, DEFAULT_FILE_PERM); err != nil {
+		return nil, err
+	}
+	if err := CopyTree(sourcePath, dest, nil); err != nil {
+		return nil, err
+	}
+	tree, err := ContentHash(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := describeSource(source)
+	entry.Tree = tree
+	// without a configured checksum the archive that was used is still worth pinning down
+	archivePath := ctx.cache.DistfilePath(source.url, source.checksums)
+	if len(entry.Checksums) == 0 && FileExists(archivePath) {
+		hash, err := fileChecksum(archivePath, "sha256")
+		if err != nil {
+			return nil, err
+		}
+		entry.Checksums["sha256"] = hash
+	}
+	if meta, err := ctx.cache.ReadMeta(source.tag); err == nil {
+		entry.Revision = meta.Revision
+	}
+	return entry, nil
+}
+
+// describeSource describes what goes into a source according to the config, everything a vendored
+// source has to match to be used in its place
+func describeSource(source *SourceTarget) *VendorSource {
+	entry := &VendorSource{
+		Id:        source.tag.id,
+		Version:   source.version,
+		Type:      source.sourceType,
+		Url:       source.url,
+		Checksums: make(map[string]string),
+		Modifiers: make([]VendorModifier, 0),
+	}
+	if source.sourceType == "git" {
+		entry.Ref, _ = source.gitRef()
+	}
+	for _, checksum := range source.checksums {
+		entry.Checksums[checksum.algorithm] = checksum.value
+	}
+
+	for _, modifier := range source.modifiers {
+		vendorModifier := VendorModifier{
+			Type:      modifier.modifierType,
+			File:      modifier.file,
+			Cmd:       modifier.cmd,
+			AllowFuzz: modifier.allowFuzz,
+			Hashes:    modifier.hashes,
+		}
+		if modifier.modifierType == "patch" || modifier.modifierType == "patches" {
+			vendorModifier.Strip = modifier.strip
+		}
+		if modifier.source != nil {
+			vendorModifier.Source = modifier.source.tag.id
+		}
+		entry.Modifiers = append(entry.Modifiers, vendorModifier)
+	}
+	return entry
+}
+
+// mismatch returns what differs between a vendored source and the source the config describes, or an
+// empty string if the vendored source can be used in its place
+func (entry *VendorSource) mismatch(expected *VendorSource) string {
+	switch {
+	case entry.Type != expected.Type || entry.Url != expected.Url:
+		return fmt.Sprintf("is from %s (%s), the config expects %s (%s)", entry.Url, entry.Type, expected.Url, expected.Type)
+	case entry.Ref != expected.Ref:
+		return fmt.Sprintf("is at %s, the config expects %s", entry.Ref, expected.Ref)
+	}
+	// a bundle records the checksum of the archive it used even if the config did not have one
+	for _, algorithm := range sortedKeys(expected.Checksums) {
+		if !strings.EqualFold(entry.Checksums[algorithm], expected.Checksums[algorithm]) {
+			return fmt.Sprintf("has a different %s checksum than the config", algorithm)
+		}
+	}
+	if !slices.EqualFunc(entry.Modifiers, expected.Modifiers, func(a VendorModifier, b VendorModifier) bool {
+		return a.Type == b.Type && a.Source == b.Source && a.File == b.File && a.Cmd == b.Cmd &&
+			a.Strip == b.Strip && a.AllowFuzz == b.AllowFuzz && slices.Equal(a.Hashes, b.Hashes)
+	}) {
+		return "was prepared with different modifiers than the config has"
+	}
+	return ""
+}
+
+// OpenVendorBundle reads a bundle written by the vendor command, a tarball is unpacked into the cache
+func OpenVendorBundle(path string, cache ChariotCache) (*VendorBundle, error) {
+	bundlePath := path
+	if strings.HasSuffix(path, ".tar.gz") {
+		bundlePath = filepath.Join(cache.ProfilePath(), "vendor")
+		if err := os.RemoveAll(bundlePath); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(bundlePath, DEFAULT_FILE_PERM); err != nil {
+			return nil, err
+		}
+		if err := ExtractArchive(path, "tar.gz", bundlePath, 0, ""); err != nil {
+			return nil, fmt.Errorf("failed to unpack vendor bundle %s: %w", path, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(bundlePath, VENDOR_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	var manifest VendorManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid vendor manifest in %s: %w", path, err)
+	}
+
+	bundle := &VendorBundle{path: bundlePath, sources: make(map[string]VendorSource)}
+	for _, source := range manifest.Sources {
+		bundle.sources[source.Id] = source
+	}
+	return bundle, nil
+}
+
+// copyVendored prepares a source from the vendor bundle, returning false if the bundle does not have it
+func (ctx *Context) copyVendored(source *SourceTarget, sourcePath string) (bool, error) {
+	if ctx.vendor == nil {
+		return false, nil
+	}
+	entry, ok := ctx.vendor.sources[source.tag.id]
+	if !ok {
+		return false, nil
+	}
+	// the bundle holds the tree as it was prepared, anything that would prepare it differently makes it stale
+	if mismatch := entry.mismatch(describeSource(source)); mismatch != "" {
+		return true, fmt.Errorf("vendored %s %s", source.tag.ToString(), mismatch)
+	}
+
+	if err := CopyTree(filepath.Join(ctx.vendor.path, entry.Id), sourcePath, nil); err != nil {
+		return true, err
+	}
+	tree, err := ContentHash(sourcePath)
+	if err != nil {
+		return true, err
+	}
+	if tree != entry.Tree {
+		return true, fmt.Errorf("vendored %s does not match the tree hash in the manifest", source.tag.ToString())
+	}
+	source.revision = entry.Revision
+	return true, nil
+}